@@ -0,0 +1,226 @@
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cpuPeriod is the cgroup v2 CPU bandwidth period, in microseconds.
+const cpuPeriod = 100000
+
+// Cgroup is a cgroup v2 control group, created beneath some root of the
+// hierarchy, into which processes can be moved to have their CPU limited, or to
+// be frozen. Implements Throttler and Freezer.
+type Cgroup struct {
+	root string
+	path string
+
+	// origins are the groups the processes were in before we moved them, to
+	// return them to.
+	origins map[int]string
+}
+
+// NewCgroup creates (or reuses) the named group under root, and enables the cpu
+// controller for it.
+func NewCgroup(root, name string) (*Cgroup, error) {
+	c := &Cgroup{root: root, path: filepath.Join(root, name), origins: make(map[int]string)}
+	if err := os.MkdirAll(c.path, 0755); err != nil {
+		return nil, err
+	}
+	if err := writeCgroupFile(filepath.Join(root, "cgroup.subtree_control"), "+cpu"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newThrottler() (Throttler, error) {
+	return NewCgroup(opts.CgroupRoot, "SpotifyWatcher")
+}
+
+// newFreezer returns a group of its own to freeze processes in, or failing
+// that, freezes them with signals.
+func newFreezer() (Freezer, error) {
+	c, err := NewCgroup(opts.CgroupRoot, "SpotifyWatcher.frozen")
+	if err != nil {
+		log.Println("Can't use the cgroup freezer, so stopping processes instead:", err)
+		return &Signals{}, nil
+	}
+	return c, nil
+}
+
+// Path returns the directory of the group in the cgroup hierarchy.
+func (c *Cgroup) Path() string {
+	return c.path
+}
+
+// SetCpuMax sets the group's CPU quota as a percentage of a single CPU. A
+// negative value removes the quota.
+func (c *Cgroup) SetCpuMax(cpu float64) error {
+	quota := "max"
+	if cpu >= 0 {
+		us := int(cpu / 100 * cpuPeriod)
+		if us < 1000 { // The kernel won't accept anything less than 1ms.
+			us = 1000
+		}
+		quota = strconv.Itoa(us)
+	}
+	return writeCgroupFile(filepath.Join(c.path, "cpu.max"), fmt.Sprintf("%s %d", quota, cpuPeriod))
+}
+
+// Procs returns the PIDs of all processes in the group.
+func (c *Cgroup) Procs() (pids []int, err error) {
+	return readCgroupProcs(filepath.Join(c.path, "cgroup.procs"))
+}
+
+// Throttle moves the process tree rooted at pid into the group, and sets the
+// group's CPU quota.
+func (c *Cgroup) Throttle(pid int, cpu float64) error {
+	if err := c.SetCpuMax(cpu); err != nil {
+		return err
+	}
+	return c.add(pid)
+}
+
+// Release moves all processes in the group back to where they came from, and
+// removes the CPU quota.
+func (c *Cgroup) Release() error {
+	if err := c.empty(); err != nil {
+		return err
+	}
+	return c.SetCpuMax(-1)
+}
+
+// Freeze moves the process tree rooted at pid into the group, and freezes the
+// group.
+func (c *Cgroup) Freeze(pid int) error {
+	if err := c.add(pid); err != nil {
+		return err
+	}
+	return writeCgroupFile(filepath.Join(c.path, "cgroup.freeze"), "1")
+}
+
+// Thaw unfreezes the group, and moves all its processes back to where they came
+// from.
+func (c *Cgroup) Thaw() error {
+	if err := writeCgroupFile(filepath.Join(c.path, "cgroup.freeze"), "0"); err != nil {
+		return err
+	}
+	return c.empty()
+}
+
+// add moves the process tree rooted at pid into the group, noting where each
+// process came from.
+func (c *Cgroup) add(pid int) error {
+	if err := c.move(pid); err != nil {
+		return err
+	}
+	for _, child := range childPids(pid) {
+		// Children come and go; don't fail if one has already exited.
+		if err := c.move(child); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cgroup) move(pid int) error {
+	origin, err := c.groupOf(pid)
+	if err != nil {
+		return err
+	}
+	if origin == c.path {
+		return nil // Already ours.
+	}
+	if err := appendCgroupFile(filepath.Join(c.path, "cgroup.procs"), strconv.Itoa(pid)); err != nil {
+		return err
+	}
+	c.origins[pid] = origin
+	return nil
+}
+
+// groupOf returns the directory of the group the process is in, from
+// /proc/<pid>/cgroup. If the process has exited, the error is ESRCH.
+func (c *Cgroup) groupOf(pid int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if os.IsNotExist(err) {
+		return "", syscall.ESRCH
+	} else if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// The v2 hierarchy is the one with ID 0, and no controllers, e.g.
+		// "0::/user.slice/user-1000.slice/session-2.scope".
+		if strings.HasPrefix(line, "0::") {
+			return filepath.Join(c.root, strings.TrimPrefix(line, "0::")), nil
+		}
+	}
+	return "", fmt.Errorf("PID %d isn't in a cgroup v2 group", pid)
+}
+
+// empty moves all processes in the group back to the groups they came from, or
+// to the root group if theirs is gone. Processes that have since exited are
+// skipped.
+func (c *Cgroup) empty() error {
+	pids, err := c.Procs()
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		origin, ok := c.origins[pid]
+		if _, err := os.Stat(origin); !ok || err != nil {
+			origin = c.root
+		}
+		err := appendCgroupFile(filepath.Join(origin, "cgroup.procs"), strconv.Itoa(pid))
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+	}
+	c.origins = make(map[int]string)
+	return nil
+}
+
+func writeCgroupFile(path, value string) error {
+	return ioutil.WriteFile(path, []byte(value+"\n"), 0644)
+}
+
+// appendCgroupFile is used for cgroup.procs, where each write moves a single
+// process, so that the result is the same on a real hierarchy as on a plain
+// directory.
+func appendCgroupFile(path, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(value + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readCgroupProcs(path string) (pids []int, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		pid, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+		if err != nil {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	return pids, scanner.Err()
+}
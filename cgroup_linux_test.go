@@ -0,0 +1,149 @@
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readTrimmed(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func TestCgroupThrottleAndRelease(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	cg, err := NewCgroup(root, "SpotifyWatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readTrimmed(t, filepath.Join(root, "cgroup.subtree_control")); got != "+cpu" {
+		t.Errorf("subtree_control: got %q, want %q", got, "+cpu")
+	}
+
+	pid := os.Getpid()
+	if err := cg.Throttle(pid, 8.0); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTrimmed(t, filepath.Join(cg.Path(), "cpu.max")); got != "8000 100000" {
+		t.Errorf("cpu.max: got %q, want %q", got, "8000 100000")
+	}
+	procs, err := cg.Procs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(procs) == 0 || procs[0] != pid {
+		t.Errorf("cgroup.procs: got %v, want %d first", procs, pid)
+	}
+
+	if err := cg.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTrimmed(t, filepath.Join(cg.Path(), "cpu.max")); got != "max 100000" {
+		t.Errorf("cpu.max: got %q, want %q", got, "max 100000")
+	}
+	released, err := readCgroupProcs(filepath.Join(root, "cgroup.procs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(released, procs) {
+		t.Errorf("root cgroup.procs: got %v, want %v", released, procs)
+	}
+}
+
+func TestCgroupReleasesToOrigin(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	cg, err := NewCgroup(root, "SpotifyWatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := os.Getpid()
+	if err := cg.Throttle(pid, 8.0); err != nil {
+		t.Fatal(err)
+	}
+	// As though it had come from a session's group, which it goes back to.
+	session := filepath.Join(root, "user.slice", "session-2.scope")
+	if err := os.MkdirAll(session, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cg.origins[pid] = session
+	if err := cg.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if released, err := readCgroupProcs(filepath.Join(session, "cgroup.procs")); err != nil || len(released) != 1 || released[0] != pid {
+		t.Errorf("session cgroup.procs: got %v (%v), want [%d]", released, err, pid)
+	}
+	if len(cg.origins) != 0 {
+		t.Errorf("origins: got %v, want none", cg.origins)
+	}
+}
+
+func TestCgroupMinimumQuota(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	cg, err := NewCgroup(root, "SpotifyWatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cg.SetCpuMax(0.1); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTrimmed(t, filepath.Join(cg.Path(), "cpu.max")); got != "1000 100000" {
+		t.Errorf("cpu.max: got %q, want %q", got, "1000 100000")
+	}
+}
+
+func TestCgroupFreezeAndThaw(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	cg, err := NewCgroup(root, "SpotifyWatcher.frozen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := os.Getpid()
+	if err := cg.Freeze(pid); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTrimmed(t, filepath.Join(cg.Path(), "cgroup.freeze")); got != "1" {
+		t.Errorf("cgroup.freeze: got %q, want %q", got, "1")
+	}
+	if procs, err := cg.Procs(); err != nil || len(procs) == 0 || procs[0] != pid {
+		t.Errorf("cgroup.procs: got %v (%v), want %d first", procs, err, pid)
+	}
+
+	if err := cg.Thaw(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTrimmed(t, filepath.Join(cg.Path(), "cgroup.freeze")); got != "0" {
+		t.Errorf("cgroup.freeze: got %q, want %q", got, "0")
+	}
+	if thawed, err := readCgroupProcs(filepath.Join(root, "cgroup.procs")); err != nil || len(thawed) == 0 || thawed[0] != pid {
+		t.Errorf("root cgroup.procs: got %v (%v), want %d first", thawed, err, pid)
+	}
+}
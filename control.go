@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+)
+
+// NewControl returns a handler for commands to the tracker, given over HTTP:
+//
+//	POST /play   Thaw Spotify if it's frozen, and tell it to play.
+//	POST /thaw   Thaw Spotify, if it's frozen.
+func NewControl(t *tracker) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/play", command(t.Play))
+	mux.HandleFunc("/thaw", command(t.Thaw))
+	return mux
+}
+
+// command runs do for each POST, answering with any error it returns.
+func command(do func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := do(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestControlPlayThaws(t *testing.T) {
+	defer withOptions(trackerTestOptions)()
+	tr, player, events := newTestTracker(StatePaused)
+	freezer := &fakeFreezer{}
+	tr.freezer, tr.frozen = freezer, true
+	server := httptest.NewServer(NewControl(tr))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/play")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || len(player.calls) != 0 {
+		t.Errorf("GET: got %s, calls %v", resp.Status, player.calls)
+	}
+
+	resp, err = http.Post(server.URL+"/play", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("POST: got %s", resp.Status)
+	}
+	if tr.frozen || !reflect.DeepEqual(freezer.calls, []string{"thaw"}) || !reflect.DeepEqual(player.calls, []string{"play"}) {
+		t.Errorf("expected a thaw then play, got freezer %v, player %v", freezer.calls, player.calls)
+	}
+	if !reflect.DeepEqual(events.types(), []EventType{EventThawed}) {
+		t.Errorf("got events %v, want %v", events.types(), []EventType{EventThawed})
+	}
+
+	// Nothing to thaw now.
+	resp, err = http.Post(server.URL+"/thaw", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || len(freezer.calls) != 1 {
+		t.Errorf("thaw: got %s, freezer %v", resp.Status, freezer.calls)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType names something the tracker did, or noticed, about the target.
+type EventType string
+
+const (
+	EventMisbehaving EventType = "misbehaving" // First breach of the threshold.
+	EventClosing     EventType = "closing"     // Told to quit.
+	EventKilled      EventType = "killed"      // Forcibly killed.
+	EventThrottled   EventType = "throttled"   // CPU limited.
+	EventReleased    EventType = "released"    // CPU limit lifted.
+	EventRecovered   EventType = "recovered"   // Median back under the threshold.
+	EventFrozen      EventType = "frozen"      // Stopped from running at all.
+	EventThawed      EventType = "thawed"      // Let run again.
+	EventExited      EventType = "exited"      // Process went away.
+	EventGivingUp    EventType = "giving-up"   // Acted too often, stopped acting.
+)
+
+// eventTypes are all the types of event there are.
+var eventTypes = []EventType{
+	EventMisbehaving, EventClosing, EventKilled, EventThrottled, EventReleased,
+	EventRecovered, EventFrozen, EventThawed, EventExited, EventGivingUp,
+}
+
+// Known returns whether the event type is one the tracker reports.
+func (t EventType) Known() bool {
+	for _, known := range eventTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is reported by the tracker, along with the context of its decision.
+type Event struct {
+	Type      EventType `json:"event"`
+	Time      time.Time `json:"time"`
+	Target    string    `json:"target"`
+	Pid       string    `json:"pid"`
+	State     State     `json:"state"`
+	Cpu       float64   `json:"cpu"`
+	Median    float64   `json:"median"`
+	Samples   int       `json:"samples"`
+	Breaches  int       `json:"breaches"`
+	Threshold float64   `json:"threshold"`
+	DryRun    bool      `json:"dry_run"`
+	Track     Track     `json:"track"`
+}
+
+// JSON returns the event encoded as a JSON object.
+func (e Event) JSON() []byte {
+	b, _ := json.Marshal(e) // Nothing in an Event can fail to marshal.
+	return b
+}
+
+// EventHandler is notified of every tracker event. HandleEvent is called from
+// the tick loop, so it must not block.
+type EventHandler interface {
+	HandleEvent(e Event)
+}
+
+// eventQueueSize is how many events may wait in an EventQueue before we start
+// dropping them.
+const eventQueueSize = 32
+
+// eventQueueDrain is how long closing an EventQueue waits for the events still
+// queued to be handled.
+var eventQueueDrain = 10 * time.Second
+
+// EventQueue handles events in the background, one at a time, so that a slow
+// handler (running a hook, or sending a request) never holds up the tick loop.
+// If it falls too far behind, events are dropped. Implements EventHandler.
+type EventQueue struct {
+	name   string // What's handling the events, for the warning when dropped.
+	handle func(e Event)
+	queue  chan Event
+	done   chan struct{} // Closed once the queue is closed and drained.
+
+	mu     sync.Mutex // Guards closed, so nothing's queued once it's closed.
+	closed bool
+
+	dropped uint64
+}
+
+// NewEventQueue starts handling events as they're queued.
+func NewEventQueue(name string, handle func(e Event)) *EventQueue {
+	q := &EventQueue{name: name, handle: handle, queue: make(chan Event, eventQueueSize), done: make(chan struct{})}
+	go q.process()
+	return q
+}
+
+// HandleEvent queues the event to be handled. If the queue is full, or closed,
+// the event is dropped.
+func (q *EventQueue) HandleEvent(e Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		log.Printf("%s is closed, dropped %q event.\n", q.name, e.Type)
+		atomic.AddUint64(&q.dropped, 1)
+		return
+	}
+	select {
+	case q.queue <- e:
+	default:
+		log.Printf("%s is falling behind, dropped %q event.\n", q.name, e.Type)
+		atomic.AddUint64(&q.dropped, 1)
+	}
+}
+
+// Dropped returns the number of events dropped for want of room in the queue.
+func (q *EventQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// Close handles whatever events are queued, and stops, giving up on them if
+// they take too long. Events handled after it's closed are dropped.
+func (q *EventQueue) Close() error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+	select {
+	case <-q.done:
+		return nil
+	case <-time.After(eventQueueDrain):
+		return fmt.Errorf("gave up on %d queued events after %s", len(q.queue), eventQueueDrain)
+	}
+}
+
+func (q *EventQueue) process() {
+	for e := range q.queue {
+		q.handle(e)
+	}
+	close(q.done)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventQueueDropsWhenFull(t *testing.T) {
+	started, block := make(chan struct{}, 1), make(chan struct{})
+	var handled []EventType
+	q := NewEventQueue("Test", func(e Event) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-block
+		handled = append(handled, e.Type)
+	})
+	// One is taken to be handled, the queue fills up behind it, and the rest
+	// are dropped.
+	q.HandleEvent(Event{Type: EventMisbehaving})
+	<-started
+	for i := 0; i < eventQueueSize+2; i++ {
+		q.HandleEvent(Event{Type: EventClosing})
+	}
+	if q.Dropped() != 2 {
+		t.Errorf("got %d dropped, want 2", q.Dropped())
+	}
+	// Closing handles what's left.
+	close(block)
+	q.Close()
+	if len(handled) != eventQueueSize+1 || handled[0] != EventMisbehaving {
+		t.Errorf("got %d handled, starting with %v, want %d", len(handled), handled[:1], eventQueueSize+1)
+	}
+}
+
+func TestEventQueueGivesUpOnClose(t *testing.T) {
+	defer func(d time.Duration) { eventQueueDrain = d }(eventQueueDrain)
+	eventQueueDrain = 10 * time.Millisecond
+	block := make(chan struct{})
+	defer close(block)
+	q := NewEventQueue("Test", func(e Event) { <-block })
+	q.HandleEvent(Event{Type: EventMisbehaving})
+	q.HandleEvent(Event{Type: EventClosing})
+	if err := q.Close(); err == nil {
+		t.Error("expected closing to give up on the blocked handler")
+	}
+	// Once closed, events are dropped rather than queued.
+	q.HandleEvent(Event{Type: EventThawed})
+	if q.Dropped() != 1 {
+		t.Errorf("got %d dropped, want 1", q.Dropped())
+	}
+}
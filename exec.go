@@ -2,7 +2,6 @@ package main
 
 import (
 	"io"
-	"log"
 	"os/exec"
 	"time"
 )
@@ -34,10 +33,10 @@ func (c *IdleCmd) Read(p []byte) (n int, err error) {
 func (c *IdleCmd) startAndWait(cmd *exec.Cmd, idleAfter time.Duration) {
 	cmd.Stdout = IdleWriter(c.buf, idleAfter, c.Idle)
 	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 }
 
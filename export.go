@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exportColumns are the columns of every exported record. Each record only has
+// some of them: a process sample, the tracker's decision for a tick, or an
+// event.
+var exportColumns = []string{
+	"timestamp", "record", "player_state", "pid", "command", "cpu", "threads", "state", "time", "pageins",
+	"median", "samples", "breaches", "allowed_breaches", "threshold",
+	"misbehaving", "closing", "throttled", "frozen", "event",
+	"track_name", "track_artist", "track_album", "track_uri",
+}
+
+// exportRecord is a row of the export, by column.
+type exportRecord map[string]interface{}
+
+// Export writes every process sample, tracker decision and event to a file, as
+// CSV or JSON Lines, for analysis elsewhere. The file may be gzipped, and once
+// it grows past the maximum size, it's moved aside (with the time added to its
+// name) and a new one started. Implements MetricSink.
+type Export struct {
+	path    string
+	format  string // "csv" or "jsonl".
+	gzip    bool
+	maxSize int64 // Or zero, for no rotation.
+
+	mu   sync.Mutex
+	file *os.File
+	size int64 // Written to the file, after compression.
+	gz   *gzip.Writer
+	buf  *bufio.Writer
+	csv  *csv.Writer
+}
+
+// OpenExport opens the file to append to, creating it if need be.
+func OpenExport(path, format string, compress bool, maxSize int64) (*Export, error) {
+	if format != "csv" && format != "jsonl" {
+		return nil, fmt.Errorf("invalid export format %q, expected csv or jsonl", format)
+	}
+	e := &Export{path: path, format: format, gzip: compress, maxSize: maxSize}
+	if err := e.open(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Export) open() error {
+	f, err := os.OpenFile(e.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	e.file, e.size = f, info.Size()
+	var w io.Writer = exportCounter{e}
+	if e.gzip {
+		// Appending to a gzipped file adds another member, which is still valid.
+		e.gz = gzip.NewWriter(w)
+		w = e.gz
+	}
+	e.buf = bufio.NewWriter(w)
+	if e.format == "csv" {
+		e.csv = csv.NewWriter(e.buf)
+		if e.size == 0 {
+			e.csv.Write(exportColumns)
+		}
+	}
+	return nil
+}
+
+// exportCounter counts what's written to the export's file.
+type exportCounter struct{ e *Export }
+
+func (c exportCounter) Write(p []byte) (int, error) {
+	n, err := c.e.file.Write(p)
+	c.e.size += int64(n)
+	return n, err
+}
+
+func (e *Export) BeginTick(now time.Time) {}
+
+func (e *Export) AddTracker(p metricPoint) {
+	r := exportRecord{"timestamp": p.Time, "record": "tracker", "player_state": p.Tags["player_state"]}
+	for _, column := range []string{"cpu", "median", "samples", "breaches", "allowed_breaches", "threshold",
+		"misbehaving", "closing", "throttled", "frozen"} {
+		if v, ok := p.Fields[column]; ok {
+			r[column] = v
+		}
+	}
+	e.write(r)
+}
+
+func (e *Export) AddProcess(p metricPoint) {
+	r := exportRecord{"timestamp": p.Time, "record": "process", "player_state": p.Tags["player_state"],
+		"pid": p.Tags["pid"], "command": p.Tags["command"]}
+	for _, column := range []string{"cpu", "threads", "state", "time", "pageins",
+		"track_name", "track_artist", "track_album", "track_uri"} {
+		if v, ok := p.Fields[column]; ok {
+			r[column] = v
+		}
+	}
+	e.write(r)
+}
+
+func (e *Export) AddEvent(ev Event) {
+	r := exportRecord{
+		"timestamp":    ev.Time,
+		"record":       "event",
+		"event":        string(ev.Type),
+		"pid":          ev.Pid,
+		"command":      ev.Target,
+		"player_state": string(ev.State),
+		"cpu":          ev.Cpu,
+		"median":       ev.Median,
+		"samples":      ev.Samples,
+		"breaches":     ev.Breaches,
+		"threshold":    ev.Threshold,
+	}
+	if ev.Track != (Track{}) {
+		r["track_name"] = ev.Track.Name
+		r["track_artist"] = ev.Track.Artist
+		r["track_album"] = ev.Track.Album
+		r["track_uri"] = ev.Track.URI
+	}
+	e.write(r)
+}
+
+func (e *Export) write(r exportRecord) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.csv != nil {
+		row := make([]string, len(exportColumns))
+		for i, column := range exportColumns {
+			row[i] = exportValue(r[column])
+		}
+		e.csv.Write(row)
+		return
+	}
+	for column, v := range r {
+		if t, ok := v.(time.Time); ok {
+			r[column] = t.Format(time.RFC3339Nano)
+		}
+	}
+	line, _ := json.Marshal(r)
+	e.buf.Write(append(line, '\n'))
+}
+
+// exportValue formats a value for CSV.
+func exportValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// Flush writes out the tick's records, and if the file has grown too big,
+// starts another.
+func (e *Export) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.flush(); err != nil {
+		return fmt.Errorf("export: %v", err)
+	}
+	if e.maxSize > 0 && e.size >= e.maxSize {
+		if err := e.rotate(); err != nil {
+			return fmt.Errorf("export: %v", err)
+		}
+	}
+	return nil
+}
+
+func (e *Export) flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if err := e.buf.Flush(); err != nil {
+		return err
+	}
+	if e.gz != nil {
+		return e.gz.Flush()
+	}
+	return nil
+}
+
+// rotate moves the file aside, e.g. samples.csv.gz to
+// samples.20261019T101500.csv.gz (or samples.20261019T101500-2.csv.gz, if one
+// was already moved aside that second), and starts another.
+func (e *Export) rotate() error {
+	if err := e.close(); err != nil {
+		return err
+	}
+	dir, name := filepath.Split(e.path)
+	ext := ""
+	if i := strings.Index(name, "."); i > 0 {
+		name, ext = name[:i], name[i:]
+	}
+	stamp := time.Now().Format("20060102T150405")
+	rotated := filepath.Join(dir, name+"."+stamp+ext)
+	for n := 2; ; n++ {
+		if _, err := os.Lstat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = filepath.Join(dir, fmt.Sprintf("%s.%s-%d%s", name, stamp, n, ext))
+	}
+	if err := os.Rename(e.path, rotated); err != nil {
+		return err
+	}
+	return e.open()
+}
+
+func (e *Export) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.close(); err != nil {
+		return fmt.Errorf("export: %v", err)
+	}
+	return nil
+}
+
+func (e *Export) close() error {
+	if err := e.flush(); err != nil {
+		e.file.Close()
+		return err
+	}
+	if e.gz != nil {
+		if err := e.gz.Close(); err != nil {
+			e.file.Close()
+			return err
+		}
+	}
+	return e.file.Close()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func exportTestTick(t *testing.T, e *Export, now time.Time) {
+	e.BeginTick(now)
+	e.AddTracker(metricPoint{"tracker", metricTags{"player_state": "paused"}, metricFields{
+		"cpu": 12.5, "median": 9.0, "samples": 5, "breaches": 1, "throttled": false, "state_errors": int64(0),
+	}, now})
+	e.AddProcess(metricPoint{"process", metricTags{"pid": "42", "command": "Spotify", "player_state": "paused"}, metricFields{
+		"cpu": 12.5, "threads": 30, "state": "S", "time": "0:01.50", "pageins": 4, "track_name": "Xtal",
+	}, now})
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "samples.csv")
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	e, err := OpenExport(path, "csv", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exportTestTick(t, e, now)
+	e.AddEvent(Event{Type: EventClosing, Time: now, Target: "Spotify", Pid: "42", State: StatePaused, Cpu: 12.5, Breaches: 2,
+		Track: Track{Name: "Xtal", Artist: "Aphex Twin", URI: "spotify:track:1"}})
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Appending doesn't repeat the header.
+	if e, err = OpenExport(path, "csv", false, 0); err != nil {
+		t.Fatal(err)
+	}
+	exportTestTick(t, e, now)
+	e.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 6 || !reflect.DeepEqual(rows[0], exportColumns) {
+		t.Fatalf("got %d rows, header %v", len(rows), rows[0])
+	}
+	want := [][]string{
+		{"2026-10-01T12:00:00Z", "tracker", "paused", "", "", "12.5", "", "", "", "", "9", "5", "1", "", "", "", "", "false", "", "", "", "", "", ""},
+		{"2026-10-01T12:00:00Z", "process", "paused", "42", "Spotify", "12.5", "30", "S", "0:01.50", "4", "", "", "", "", "", "", "", "", "", "", "Xtal", "", "", ""},
+		{"2026-10-01T12:00:00Z", "event", "paused", "42", "Spotify", "12.5", "", "", "", "", "0", "0", "2", "", "0", "", "", "", "", "closing",
+			"Xtal", "Aphex Twin", "", "spotify:track:1"},
+	}
+	if !reflect.DeepEqual(rows[1:4], want) {
+		t.Errorf("got %q, want %q", rows[1:4], want)
+	}
+}
+
+func TestExportJSONLinesRotatesAndGzips(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "samples.jsonl.gz")
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	e, err := OpenExport(path, "jsonl", true, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exportTestTick(t, e, now)
+	e.AddEvent(Event{Type: EventKilled, Time: now})
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rotated, _ := filepath.Glob(filepath.Join(dir, "samples.*.jsonl.gz"))
+	if len(rotated) != 1 {
+		t.Fatalf("got rotated files %v, want 1", rotated)
+	}
+
+	var records []map[string]interface{}
+	for _, name := range []string{rotated[0], path} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(gz)
+		for scanner.Scan() {
+			var r map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, r)
+		}
+		f.Close()
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3: %v", len(records), records)
+	}
+	process := map[string]interface{}{
+		"timestamp": "2026-10-01T12:00:00Z", "record": "process", "player_state": "paused", "pid": "42", "command": "Spotify",
+		"cpu": 12.5, "threads": 30.0, "state": "S", "time": "0:01.50", "pageins": 4.0, "track_name": "Xtal",
+	}
+	if !reflect.DeepEqual(records[1], process) {
+		t.Errorf("got %v, want %v", records[1], process)
+	}
+	if records[2]["record"] != "event" || records[2]["event"] != "killed" {
+		t.Errorf("got %v, want the killed event, in the new file", records[2])
+	}
+}
+
+func TestExportRotatesWithoutOverwriting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "samples.csv")
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	e, err := OpenExport(path, "csv", false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Likely all in the same second.
+	for i := 0; i < 3; i++ {
+		exportTestTick(t, e, now)
+	}
+	e.Close()
+	rotated, _ := filepath.Glob(filepath.Join(dir, "samples.*.csv"))
+	if len(rotated) != 3 {
+		t.Errorf("got rotated files %v, want 3", rotated)
+	}
+}
+
+func TestExportFormat(t *testing.T) {
+	if _, err := OpenExport(filepath.Join(os.TempDir(), "never"), "xml", false, 0); err == nil {
+		t.Error("got no error for xml")
+	}
+}
@@ -0,0 +1,10 @@
+package main
+
+// Freezer stops a process and its children from running at all, without them
+// noticing, until thawed.
+type Freezer interface {
+	// Freeze stops the process tree rooted at pid.
+	Freeze(pid int) error
+	// Thaw lets the frozen processes carry on where they left off.
+	Thaw() error
+}
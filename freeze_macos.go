@@ -0,0 +1,7 @@
+// +build darwin
+
+package main
+
+func newFreezer() (Freezer, error) {
+	return &Signals{}, nil
+}
@@ -0,0 +1,9 @@
+// +build !darwin,!linux
+
+package main
+
+import "errors"
+
+func newFreezer() (Freezer, error) {
+	return nil, errors.New("Freezing processes is only supported on macOS and Linux")
+}
@@ -0,0 +1,31 @@
+// +build darwin linux
+
+package main
+
+import "syscall"
+
+// Signals freezes processes with SIGSTOP, and thaws them with SIGCONT.
+// Implements Freezer.
+type Signals struct {
+	pids []int
+}
+
+func (s *Signals) Freeze(pid int) error {
+	s.pids = append([]int{pid}, childPids(pid)...)
+	if err := syscall.Kill(pid, syscall.SIGSTOP); err != nil {
+		return err
+	}
+	for _, child := range s.pids[1:] {
+		// Children come and go; don't fail if one has already exited.
+		syscall.Kill(child, syscall.SIGSTOP)
+	}
+	return nil
+}
+
+func (s *Signals) Thaw() error {
+	for _, pid := range s.pids {
+		syscall.Kill(pid, syscall.SIGCONT)
+	}
+	s.pids = nil
+	return nil
+}
@@ -0,0 +1,67 @@
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// procState returns the state of a process, as /proc/[pid]/stat has it.
+func procState(t *testing.T, pid int) string {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := parseProcStat(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.State
+}
+
+// waitForState polls until the process is in the given state, or fails after
+// a while, as signals are delivered asynchronously.
+func waitForState(t *testing.T, pid int, state string) {
+	for i := 0; i < 100; i++ {
+		if procState(t, pid) == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("PID %d: got state %s, want %s", pid, procState(t, pid), state)
+}
+
+func TestSignalsFreezeAndThaw(t *testing.T) {
+	sh := exec.Command("sh", "-c", "sleep 60 & wait")
+	if err := sh.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sh.Wait()
+	defer exec.Command("pkill", "-P", strconv.Itoa(sh.Process.Pid)).Run()
+	defer sh.Process.Kill()
+
+	var children []int
+	for i := 0; i < 100 && len(children) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		children = childPids(sh.Process.Pid)
+	}
+	if len(children) == 0 {
+		t.Fatal("shell didn't start its child")
+	}
+
+	s := &Signals{}
+	if err := s.Freeze(sh.Process.Pid); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, sh.Process.Pid, "T")
+	waitForState(t, children[0], "T")
+	if err := s.Thaw(); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, sh.Process.Pid, "S")
+	waitForState(t, children[0], "S")
+}
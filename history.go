@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	historyDay    = "2006-01-02"
+	historyBucket = 5 * time.Minute // What raw samples are downsampled to.
+	historyCpuBin = 0.5             // CPU resolution of downsampled samples.
+)
+
+// historySample is a tick's worth of what the tracker saw, or once it's been
+// downsampled, a summary of every tick in a bucket with the same state and
+// (about) the same CPU.
+type historySample struct {
+	Time    time.Time `json:"time"`
+	State   string    `json:"state"`
+	Cpu     float64   `json:"cpu"`
+	Count   int       `json:"count,omitempty"` // Ticks summarized, if more than one.
+	Seconds float64   `json:"seconds"`
+}
+
+func (s historySample) ticks() int {
+	if s.Count == 0 {
+		return 1
+	}
+	return s.Count
+}
+
+// HistoryStore keeps a local history of the tracker's samples and events, for
+// those who don't have InfluxDB. It's a directory of JSON Lines files, one per
+// kind and day: samples-DAY.jsonl for every tick, downsampled-DAY.jsonl once
+// those are older than raw, and events-DAY.jsonl. Everything older than keep
+// is removed. Implements MetricSink.
+type HistoryStore struct {
+	dir      string
+	interval time.Duration // Between ticks.
+	raw      time.Duration
+	keep     time.Duration
+
+	mu        sync.Mutex
+	sample    *historySample // This tick's.
+	compacted string         // Day of the last compaction.
+}
+
+// OpenHistoryStore creates the history directory, if need be.
+func OpenHistoryStore(dir string, interval, raw, keep time.Duration) (*HistoryStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &HistoryStore{dir: dir, interval: interval, raw: raw, keep: keep}, nil
+}
+
+func (h *HistoryStore) BeginTick(now time.Time) {
+	h.sample = nil
+}
+
+func (h *HistoryStore) AddTracker(p metricPoint) {
+	cpu, _ := p.Fields["cpu"].(float64)
+	h.sample = &historySample{Time: p.Time, State: p.Tags["player_state"], Cpu: cpu, Seconds: h.interval.Seconds()}
+}
+
+func (h *HistoryStore) AddProcess(p metricPoint) {}
+
+func (h *HistoryStore) AddEvent(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.appendLine("events", e.Time, e.JSON())
+}
+
+// Flush records the tick's sample, and once a day, downsamples and removes
+// what's old.
+func (h *HistoryStore) Flush() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sample == nil {
+		return nil
+	}
+	line, _ := json.Marshal(h.sample)
+	if err := h.appendLine("samples", h.sample.Time, line); err != nil {
+		return fmt.Errorf("history: %v", err)
+	}
+	if day := h.sample.Time.Format(historyDay); day != h.compacted {
+		h.compacted = day
+		if err := h.Compact(h.sample.Time); err != nil {
+			return fmt.Errorf("history: %v", err)
+		}
+	}
+	return nil
+}
+
+func (h *HistoryStore) Close() error {
+	return nil
+}
+
+func (h *HistoryStore) path(kind string, day string) string {
+	return filepath.Join(h.dir, kind+"-"+day+".jsonl")
+}
+
+func (h *HistoryStore) appendLine(kind string, t time.Time, line []byte) error {
+	f, err := os.OpenFile(h.path(kind, t.Format(historyDay)), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// days returns the days with files of the given kind, oldest first.
+func (h *HistoryStore) days(kind string) []string {
+	names, _ := filepath.Glob(filepath.Join(h.dir, kind+"-*.jsonl"))
+	days := make([]string, len(names))
+	for i, name := range names {
+		days[i] = strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), kind+"-"), ".jsonl")
+	}
+	sort.Strings(days)
+	return days
+}
+
+// Compact downsamples the raw samples of days that have passed out of the raw
+// window, and removes days that have passed out of the keep window.
+func (h *HistoryStore) Compact(now time.Time) error {
+	for _, kind := range []string{"samples", "downsampled", "events"} {
+		for _, day := range h.days(kind) {
+			start, err := time.ParseInLocation(historyDay, day, now.Location())
+			if err != nil {
+				continue // Not ours.
+			}
+			end := start.AddDate(0, 0, 1)
+			switch {
+			case now.Sub(end) > h.keep:
+				if err := os.Remove(h.path(kind, day)); err != nil {
+					return err
+				}
+			case kind == "samples" && now.Sub(end) > h.raw:
+				if err := h.downsample(day); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// downsample summarizes a day's raw samples, replacing them.
+func (h *HistoryStore) downsample(day string) error {
+	var samples []historySample
+	if err := readJSONLines(h.path("samples", day), func(line []byte) error {
+		var s historySample
+		if err := json.Unmarshal(line, &s); err != nil {
+			return err
+		}
+		samples = append(samples, s)
+		return nil
+	}); err != nil {
+		return err
+	}
+	type key struct {
+		bucket time.Time
+		state  string
+		cpu    float64
+	}
+	summaries := make(map[key]*historySample)
+	var order []key
+	for _, s := range samples {
+		k := key{s.Time.Truncate(historyBucket), s.State, math.Round(s.Cpu/historyCpuBin) * historyCpuBin}
+		summary, ok := summaries[k]
+		if !ok {
+			summary = &historySample{Time: k.bucket, State: k.state, Cpu: k.cpu}
+			summaries[k] = summary
+			order = append(order, k)
+		}
+		summary.Count += s.ticks()
+		summary.Seconds += s.Seconds
+	}
+	f, err := os.OpenFile(h.path("downsampled", day), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, k := range order {
+		line, _ := json.Marshal(summaries[k])
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(h.path("samples", day))
+}
+
+// readJSONLines calls do with each line of the file, stopping at the first
+// error.
+func readJSONLines(path string, do func(line []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := do(scanner.Bytes()); err != nil {
+			return fmt.Errorf("%s: %v", filepath.Base(path), err)
+		}
+	}
+	return scanner.Err()
+}
+
+// historySummary is what happened over a time range.
+type historySummary struct {
+	From, To    time.Time
+	Ticks       int
+	Percentiles map[float64]float64 // CPU, while running.
+	Max         float64
+	StateTime   map[string]time.Duration
+	Events      map[EventType]int
+}
+
+// historyPercentiles are the CPU percentiles summarized.
+var historyPercentiles = []float64{50, 90, 95, 99}
+
+// Summarize reads the history between from and to.
+func (h *HistoryStore) Summarize(from, to time.Time) (s historySummary, err error) {
+	s = historySummary{
+		From:        from,
+		To:          to,
+		Percentiles: make(map[float64]float64),
+		StateTime:   make(map[string]time.Duration),
+		Events:      make(map[EventType]int),
+	}
+	inRange := func(day string) bool {
+		return day >= from.Format(historyDay) && day <= to.Format(historyDay)
+	}
+	var running []historySample
+	for _, kind := range []string{"downsampled", "samples"} {
+		for _, day := range h.days(kind) {
+			if !inRange(day) {
+				continue
+			}
+			err = readJSONLines(h.path(kind, day), func(line []byte) error {
+				var sample historySample
+				if err := json.Unmarshal(line, &sample); err != nil {
+					return err
+				}
+				if sample.Time.Before(from) || sample.Time.After(to) {
+					return nil
+				}
+				s.Ticks += sample.ticks()
+				s.StateTime[sample.State] += time.Duration(sample.Seconds * float64(time.Second))
+				if sample.State != string(StateClosed) {
+					running = append(running, sample)
+				}
+				return nil
+			})
+			if err != nil {
+				return
+			}
+		}
+	}
+	for _, day := range h.days("events") {
+		if !inRange(day) {
+			continue
+		}
+		err = readJSONLines(h.path("events", day), func(line []byte) error {
+			var e Event
+			if err := json.Unmarshal(line, &e); err != nil {
+				return err
+			}
+			if !e.Time.Before(from) && !e.Time.After(to) {
+				s.Events[e.Type]++
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].Cpu < running[j].Cpu })
+	total := 0
+	for _, sample := range running {
+		total += sample.ticks()
+	}
+	if total == 0 {
+		return
+	}
+	s.Max = running[len(running)-1].Cpu
+	for _, p := range historyPercentiles {
+		seen, want := 0, int(math.Ceil(p/100*float64(total)))
+		for _, sample := range running {
+			if seen += sample.ticks(); seen >= want {
+				s.Percentiles[p] = sample.Cpu
+				break
+			}
+		}
+	}
+	return
+}
+
+// Print writes the summary out for people.
+func (s historySummary) Print(w io.Writer) {
+	fmt.Fprintf(w, "From %s to %s, %d ticks.\n", s.From.Format(time.RFC3339), s.To.Format(time.RFC3339), s.Ticks)
+	if len(s.Percentiles) > 0 {
+		var ps []string
+		for _, p := range historyPercentiles {
+			ps = append(ps, fmt.Sprintf("p%s %.1f", strconv.FormatFloat(p, 'f', -1, 64), s.Percentiles[p]))
+		}
+		fmt.Fprintf(w, "\nCPU while running: %s, max %.1f\n", strings.Join(ps, ", "), s.Max)
+	}
+	if len(s.StateTime) > 0 {
+		fmt.Fprintln(w, "\nTime per state:")
+		var states []string
+		for state := range s.StateTime {
+			states = append(states, state)
+		}
+		sort.Strings(states)
+		for _, state := range states {
+			name := state
+			if name == "" {
+				name = "unknown"
+			}
+			fmt.Fprintf(w, "  %-12s %s\n", name, s.StateTime[state].Round(time.Second))
+		}
+	}
+	if len(s.Events) > 0 {
+		fmt.Fprintln(w, "\nEvents:")
+		var types []string
+		for t := range s.Events {
+			types = append(types, string(t))
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			fmt.Fprintf(w, "  %-12s %d\n", t, s.Events[EventType(t)])
+		}
+	}
+}
+
+// parseHistoryTime parses a time given as "now", how long ago (e.g. "90m",
+// "24h" or "7d"), a date, or a date and time.
+func parseHistoryTime(s string, now time.Time) (time.Time, error) {
+	if s == "now" {
+		return now, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", historyDay} {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected e.g. 24h, 7d, 2006-01-02 or 2006-01-02T15:04", s)
+}
+
+// showHistory prints a summary of the history over the range in the options.
+func showHistory(w io.Writer) error {
+	now := time.Now()
+	from, err := parseHistoryTime(opts.From, now)
+	if err != nil {
+		return err
+	}
+	to, err := parseHistoryTime(opts.To, now)
+	if err != nil {
+		return err
+	}
+	dir := expandHome(opts.HistoryDir)
+	if _, err := ioutil.ReadDir(dir); err != nil {
+		return fmt.Errorf("no history kept yet (see --keep-history): %v", err)
+	}
+	h := &HistoryStore{dir: dir}
+	s, err := h.Summarize(from, to)
+	if err != nil {
+		return err
+	}
+	s.Print(w)
+	return nil
+}
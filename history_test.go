@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHistoryStore(t *testing.T) (h *HistoryStore, cleanup func()) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err = OpenHistoryStore(dir, 4*time.Second, 48*time.Hour, 10*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, func() { os.RemoveAll(dir) }
+}
+
+// recordHistory records a tick every 4s from start, for each of the CPUs given,
+// with the state given.
+func recordHistory(t *testing.T, h *HistoryStore, start time.Time, state string, cpus ...float64) time.Time {
+	for _, cpu := range cpus {
+		h.BeginTick(start)
+		h.AddTracker(metricPoint{"tracker", metricTags{"player_state": state}, metricFields{"cpu": cpu}, start})
+		h.AddProcess(metricPoint{"process", metricTags{"pid": "1"}, metricFields{"cpu": cpu}, start})
+		if err := h.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		start = start.Add(4 * time.Second)
+	}
+	return start
+}
+
+var historyTestStart = time.Date(2026, 10, 1, 12, 0, 0, 0, time.Local)
+
+func TestHistorySummary(t *testing.T) {
+	h, cleanup := newTestHistoryStore(t)
+	defer cleanup()
+	next := recordHistory(t, h, historyTestStart, "paused", 1, 2, 3, 4, 5, 6, 7, 8, 9, 30)
+	h.AddEvent(Event{Type: EventMisbehaving, Time: next})
+	h.AddEvent(Event{Type: EventClosing, Time: next})
+	next = recordHistory(t, h, next, "closed", 0, 0, 0)
+	h.AddEvent(Event{Type: EventClosing, Time: next.Add(time.Hour)}) // Out of range.
+
+	s, err := h.Summarize(historyTestStart, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Ticks != 13 {
+		t.Errorf("got %d ticks, want 13", s.Ticks)
+	}
+	// The closed ticks don't count towards CPU.
+	if want := map[float64]float64{50: 5, 90: 9, 95: 30, 99: 30}; !reflect.DeepEqual(s.Percentiles, want) || s.Max != 30 {
+		t.Errorf("got percentiles %v, max %v, want %v, max 30", s.Percentiles, s.Max, want)
+	}
+	if want := map[string]time.Duration{"paused": 40 * time.Second, "closed": 12 * time.Second}; !reflect.DeepEqual(s.StateTime, want) {
+		t.Errorf("got state times %v, want %v", s.StateTime, want)
+	}
+	if want := map[EventType]int{EventMisbehaving: 1, EventClosing: 1}; !reflect.DeepEqual(s.Events, want) {
+		t.Errorf("got events %v, want %v", s.Events, want)
+	}
+
+	var out bytes.Buffer
+	s.Print(&out)
+	for _, want := range []string{"13 ticks", "p50 5.0, p90 9.0, p95 30.0, p99 30.0, max 30.0", "paused       40s", "closing      1"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestHistoryDownsamplesAndForgets(t *testing.T) {
+	h, cleanup := newTestHistoryStore(t)
+	defer cleanup()
+	old := historyTestStart.AddDate(0, 0, -20)
+	recordHistory(t, h, old, "paused", 1, 1)
+	h.AddEvent(Event{Type: EventKilled, Time: old})
+	next := recordHistory(t, h, historyTestStart, "playing", 1.1, 0.9, 2, 1)
+	recordHistory(t, h, next, "paused", 1)
+	before, err := h.Summarize(historyTestStart, historyTestStart.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A few days on, the raw samples are summarized, and the old days are gone.
+	if err := h.Compact(historyTestStart.AddDate(0, 0, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if days := h.days("samples"); len(days) != 0 {
+		t.Errorf("got raw samples for %v, want none", days)
+	}
+	if days := h.days("downsampled"); !reflect.DeepEqual(days, []string{"2026-10-01"}) {
+		t.Errorf("got downsampled days %v", days)
+	}
+	if days := h.days("events"); len(days) != 0 {
+		t.Errorf("got events for %v, want none", days)
+	}
+	lines, _ := ioutil.ReadFile(h.path("downsampled", "2026-10-01"))
+	if n := strings.Count(string(lines), "\n"); n != 3 {
+		t.Errorf("got %d summaries, want 3 (1%% playing, 2%% playing, 1%% paused):\n%s", n, lines)
+	}
+
+	after, err := h.Summarize(historyTestStart, historyTestStart.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Ticks != before.Ticks || !reflect.DeepEqual(after.StateTime, before.StateTime) {
+		t.Errorf("got %d ticks, %v, want %d, %v", after.Ticks, after.StateTime, before.Ticks, before.StateTime)
+	}
+	if after.Percentiles[50] != 1 || after.Max != 2 {
+		t.Errorf("got p50 %v, max %v, want 1 and 2", after.Percentiles[50], after.Max)
+	}
+}
+
+var parseHistoryTimeTestTable = []struct {
+	in   string
+	want time.Time
+}{
+	{"now", historyTestStart},
+	{"90m", historyTestStart.Add(-90 * time.Minute)},
+	{"7d", historyTestStart.AddDate(0, 0, -7)},
+	{"2026-09-30", time.Date(2026, 9, 30, 0, 0, 0, 0, time.Local)},
+	{"2026-09-30T08:15", time.Date(2026, 9, 30, 8, 15, 0, 0, time.Local)},
+	{"2026-09-30T08:15:00Z", time.Date(2026, 9, 30, 8, 15, 0, 0, time.UTC)},
+}
+
+func TestParseHistoryTime(t *testing.T) {
+	for _, tt := range parseHistoryTimeTestTable {
+		if got, err := parseHistoryTime(tt.in, historyTestStart); err != nil || !got.Equal(tt.want) {
+			t.Errorf("%s: got %v (%v), want %v", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := parseHistoryTime("yesterday", historyTestStart); err == nil {
+		t.Error("yesterday: got no error")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Hook is a shell command to run whenever the tracker reports a matching event.
+type Hook struct {
+	Event   EventType // Empty matches all events.
+	Command string
+}
+
+// ParseHook parses a hook given as "EVENT=COMMAND", where EVENT is the type of
+// event, or "all".
+func ParseHook(spec string) (h Hook, err error) {
+	i := strings.Index(spec, "=")
+	if i < 1 || strings.TrimSpace(spec[i+1:]) == "" {
+		return h, fmt.Errorf("invalid hook %q, expected EVENT=COMMAND", spec)
+	}
+	h.Event = EventType(spec[:i])
+	h.Command = spec[i+1:]
+	if h.Event == "all" {
+		h.Event = ""
+	} else if !h.Event.Known() {
+		return Hook{}, fmt.Errorf("invalid hook %q, unknown event %q", spec, h.Event)
+	}
+	return
+}
+
+// Matches returns whether the hook should be run for the event.
+func (h Hook) Matches(e Event) bool {
+	return h.Event == "" || h.Event == e.Type
+}
+
+// HookRunner runs hooks in the background, one at a time. Each hook is passed
+// the event as environment variables and as JSON on stdin, and is killed if it
+// runs for too long. Implements EventHandler.
+type HookRunner struct {
+	*EventQueue
+	hooks   []Hook
+	timeout time.Duration
+
+	failures uint64
+}
+
+// NewHookRunner starts running the hooks for events as they're handled.
+func NewHookRunner(hooks []Hook, timeout time.Duration) *HookRunner {
+	r := &HookRunner{hooks: hooks, timeout: timeout}
+	r.EventQueue = NewEventQueue("Hooks", r.runHooks)
+	return r
+}
+
+// Failures returns the number of hooks that have failed, timed out or been
+// dropped.
+func (r *HookRunner) Failures() uint64 {
+	return atomic.LoadUint64(&r.failures) + r.Dropped()
+}
+
+func (r *HookRunner) runHooks(e Event) {
+	for _, h := range r.hooks {
+		if !h.Matches(e) {
+			continue
+		}
+		if err := r.run(h, e); err != nil {
+			log.Printf("Hook %q failed on %q event: %s\n", h.Command, e.Type, err)
+			atomic.AddUint64(&r.failures, 1)
+		}
+	}
+}
+
+func (r *HookRunner) run(h Hook, e Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.Command)
+	cmd.Env = append(os.Environ(), hookEnv(e)...)
+	cmd.Stdin = bytes.NewReader(e.JSON())
+	cmd.WaitDelay = time.Second // Don't wait on stray children holding our output open.
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", r.timeout)
+	}
+	if err != nil && len(out) > 0 {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(out))
+	}
+	return err
+}
+
+func hookEnv(e Event) []string {
+	return []string{
+		"SPOTIFYWATCHER_EVENT=" + string(e.Type),
+		"SPOTIFYWATCHER_TARGET=" + e.Target,
+		"SPOTIFYWATCHER_PID=" + e.Pid,
+		"SPOTIFYWATCHER_STATE=" + string(e.State),
+		"SPOTIFYWATCHER_CPU=" + strconv.FormatFloat(e.Cpu, 'f', 2, 64),
+		"SPOTIFYWATCHER_MEDIAN=" + strconv.FormatFloat(e.Median, 'f', 2, 64),
+		"SPOTIFYWATCHER_BREACHES=" + strconv.Itoa(e.Breaches),
+		"SPOTIFYWATCHER_DRY_RUN=" + strconv.FormatBool(e.DryRun),
+		"SPOTIFYWATCHER_TRACK_NAME=" + e.Track.Name,
+		"SPOTIFYWATCHER_TRACK_ARTIST=" + e.Track.Artist,
+		"SPOTIFYWATCHER_TRACK_ALBUM=" + e.Track.Album,
+		"SPOTIFYWATCHER_TRACK_URI=" + e.Track.URI,
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var parseHookTestTable = []struct {
+	spec string
+	hook Hook
+	ok   bool
+}{
+	{"killed=echo bye", Hook{EventKilled, "echo bye"}, true},
+	{"all=logger -t spotify", Hook{"", "logger -t spotify"}, true},
+	{"closing=a=b", Hook{EventClosing, "a=b"}, true},
+	{"=echo", Hook{}, false},
+	{"killed=", Hook{}, false},
+	{"killed", Hook{}, false},
+	{"kiled=echo bye", Hook{}, false},
+	{"Killed=echo bye", Hook{}, false},
+	{"giving-up=echo bye", Hook{EventGivingUp, "echo bye"}, true},
+}
+
+func TestParseHook(t *testing.T) {
+	for _, tt := range parseHookTestTable {
+		hook, err := ParseHook(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseHook(%q): unexpected error %v", tt.spec, err)
+			continue
+		}
+		if tt.ok && hook != tt.hook {
+			t.Errorf("ParseHook(%q): got %+v, want %+v", tt.spec, hook, tt.hook)
+		}
+	}
+}
+
+// waitForFile polls until the file has content, or fails after a while.
+func waitForFile(t *testing.T, path string) []byte {
+	for i := 0; i < 100; i++ {
+		if data, err := ioutil.ReadFile(path); err == nil && len(data) > 0 {
+			return data
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", path)
+	return nil
+}
+
+func TestHookRunnerPassesEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stdin := filepath.Join(dir, "stdin")
+	env := filepath.Join(dir, "env")
+
+	r := NewHookRunner([]Hook{
+		{EventClosing, "echo wrong > " + env},
+		{EventKilled, "env > " + env + ".tmp && mv " + env + ".tmp " + env},
+		{"", "cat > " + stdin + ".tmp && mv " + stdin + ".tmp " + stdin},
+	}, 5*time.Second)
+	r.HandleEvent(Event{Type: EventKilled, Target: "Spotify", Pid: "123", State: StatePaused, Cpu: 12.5, Breaches: 25,
+		Track: Track{Name: "Windowlicker", Artist: "Aphex Twin"}})
+
+	var e Event
+	if err := json.Unmarshal(waitForFile(t, stdin), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != EventKilled || e.Pid != "123" || e.Breaches != 25 || e.Track.Name != "Windowlicker" {
+		t.Errorf("unexpected event on stdin: %+v", e)
+	}
+	vars := string(waitForFile(t, env))
+	for _, v := range []string{"SPOTIFYWATCHER_EVENT=killed", "SPOTIFYWATCHER_PID=123", "SPOTIFYWATCHER_CPU=12.50", "SPOTIFYWATCHER_STATE=paused", "SPOTIFYWATCHER_TRACK_ARTIST=Aphex Twin"} {
+		if !strings.Contains(vars, v) {
+			t.Errorf("missing %s in hook environment", v)
+		}
+	}
+	if r.Failures() != 0 {
+		t.Errorf("got %d failures, want 0", r.Failures())
+	}
+}
+
+func TestHookRunnerTimeout(t *testing.T) {
+	r := NewHookRunner(nil, 100*time.Millisecond)
+	start := time.Now()
+	err := r.run(Hook{"", "sleep 5"}, Event{Type: EventKilled})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected timeout, got %v", err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("hook ran for %s, should have been killed", time.Since(start))
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// IdleMonitor tells how long the user has been idle for, and whether the screen
+// is locked.
+type IdleMonitor interface {
+	Idle(ctx context.Context) (idle time.Duration, locked bool, err error)
+}
+
+// idleMonitors asks several monitors, and believes whichever thinks the user
+// has been idle the longest. It only fails if they all do.
+type idleMonitors []IdleMonitor
+
+func (ms idleMonitors) Idle(ctx context.Context) (idle time.Duration, locked bool, err error) {
+	ok := false
+	for _, m := range ms {
+		i, l, e := m.Idle(ctx)
+		if e != nil {
+			err = e
+			continue
+		}
+		ok = true
+		if i > idle {
+			idle = i
+		}
+		locked = locked || l
+	}
+	if ok {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,93 @@
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	logindDest    = "org.freedesktop.login1"
+	logindSession = "org.freedesktop.login1.Session"
+	// logindAuto is our own session, or else the user's graphical one.
+	logindAuto = dbus.ObjectPath("/org/freedesktop/login1/session/auto")
+)
+
+// Logind reads the session's idle and locked hints from systemd-logind, which
+// the desktop environment keeps up to date. Implements IdleMonitor.
+type Logind struct {
+	conn    *dbus.Conn
+	session dbus.ObjectPath
+}
+
+// NewLogind returns a monitor for the logind session at the given path.
+func NewLogind(conn *dbus.Conn, session dbus.ObjectPath) Logind {
+	return Logind{conn: conn, session: session}
+}
+
+func (l Logind) Idle(ctx context.Context) (idle time.Duration, locked bool, err error) {
+	var props map[string]dbus.Variant
+	err = l.conn.Object(logindDest, l.session).CallWithContext(ctx,
+		"org.freedesktop.DBus.Properties.GetAll", 0, logindSession).Store(&props)
+	if err != nil {
+		return
+	}
+	locked, _ = props["LockedHint"].Value().(bool)
+	if hint, _ := props["IdleHint"].Value().(bool); hint {
+		// Microseconds since the epoch.
+		if since, ok := props["IdleSinceHint"].Value().(uint64); ok && since > 0 {
+			idle = time.Since(time.Unix(0, int64(since)*int64(time.Microsecond)))
+		}
+	}
+	return
+}
+
+// XScreenSaver reads the time since the last keyboard or mouse input on an X
+// display, from the MIT-SCREEN-SAVER extension, using xprintidle. Implements
+// IdleMonitor.
+type XScreenSaver struct {
+	display string
+}
+
+// NewXScreenSaver returns a monitor for an X display, such as ":0".
+func NewXScreenSaver(display string) XScreenSaver {
+	return XScreenSaver{display: display}
+}
+
+func (x XScreenSaver) Idle(ctx context.Context) (idle time.Duration, locked bool, err error) {
+	cmd := exec.CommandContext(ctx, "xprintidle")
+	cmd.Env = append(os.Environ(), "DISPLAY="+x.display)
+	out, err := cmd.Output()
+	if err != nil {
+		return
+	}
+	ms, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("xprintidle: bad output %q", out)
+	}
+	return time.Duration(ms) * time.Millisecond, false, nil
+}
+
+// newIdleMonitor returns our logind session and, if there is one, the X
+// display's screensaver.
+func newIdleMonitor() (IdleMonitor, error) {
+	var ms idleMonitors
+	if conn, err := dbus.SystemBus(); err == nil {
+		ms = append(ms, NewLogind(conn, logindAuto))
+	}
+	if display := os.Getenv("DISPLAY"); display != "" {
+		ms = append(ms, NewXScreenSaver(display))
+	}
+	if len(ms) == 0 {
+		return nil, fmt.Errorf("Can't tell when the user is idle, without logind or an X display")
+	}
+	return ms, nil
+}
@@ -0,0 +1,53 @@
+// +build linux
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+func TestLogindIdle(t *testing.T) {
+	addr, cleanup := privateBus(t)
+	defer cleanup()
+
+	service, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	if reply, err := service.RequestName(logindDest, dbus.NameFlagDoNotQueue); err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("couldn't own %s: %v", logindDest, err)
+	}
+	since := time.Now().Add(-time.Hour)
+	props, err := prop.Export(service, logindAuto, prop.Map{
+		logindSession: {
+			"IdleHint":      {Value: false, Emit: prop.EmitTrue},
+			"IdleSinceHint": {Value: uint64(since.UnixNano() / int64(time.Microsecond)), Emit: prop.EmitTrue},
+			"LockedHint":    {Value: false, Emit: prop.EmitTrue},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	l := NewLogind(conn, logindAuto)
+
+	if idle, locked, err := l.Idle(context.Background()); err != nil || idle != 0 || locked {
+		t.Errorf("active: got %s, locked %t (%v)", idle, locked, err)
+	}
+	props.SetMust(logindSession, "IdleHint", true)
+	props.SetMust(logindSession, "LockedHint", true)
+	if idle, locked, err := l.Idle(context.Background()); err != nil || idle < time.Hour || idle > time.Hour+time.Minute || !locked {
+		t.Errorf("idle: got %s, locked %t (%v), want an hour, locked", idle, locked, err)
+	}
+}
@@ -0,0 +1,20 @@
+// +build darwin
+
+package main
+
+import "testing"
+
+func TestParseHIDIdleTime(t *testing.T) {
+	out := `+-o IOHIDSystem  <class IOHIDSystem, id 0x100000488, registered, matched, active, busy 0 (0 ms), retain 26>
+    {
+      "HIDIdleTime" = 4242000000
+      "HIDParameters" = {"HIDClickTime"=500000000}
+    }
+`
+	if ns, err := parseHIDIdleTime(out); err != nil || ns != 4242000000 {
+		t.Errorf("got %d (%v), want 4242000000", ns, err)
+	}
+	if _, err := parseHIDIdleTime("nothing here"); err == nil {
+		t.Error("expected error without HIDIdleTime")
+	}
+}
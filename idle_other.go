@@ -0,0 +1,9 @@
+// +build !darwin,!linux
+
+package main
+
+import "errors"
+
+func newIdleMonitor() (IdleMonitor, error) {
+	return nil, errors.New("Telling when the user is idle is only supported on macOS and Linux")
+}
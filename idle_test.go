@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeIdle is an IdleMonitor that reports a fixed idle time, lock or error.
+type fakeIdle struct {
+	idle   time.Duration
+	locked bool
+	err    error
+}
+
+func (f fakeIdle) Idle(ctx context.Context) (time.Duration, bool, error) {
+	return f.idle, f.locked, f.err
+}
+
+var idleMonitorsTestTable = []struct {
+	monitors idleMonitors
+	idle     time.Duration
+	locked   bool
+	ok       bool
+}{
+	{idleMonitors{fakeIdle{idle: time.Minute}, fakeIdle{idle: time.Hour}}, time.Hour, false, true},
+	{idleMonitors{fakeIdle{locked: true}, fakeIdle{idle: time.Minute}}, time.Minute, true, true},
+	{idleMonitors{fakeIdle{err: errors.New("no logind")}, fakeIdle{idle: time.Minute}}, time.Minute, false, true},
+	{idleMonitors{fakeIdle{err: errors.New("no logind")}}, 0, false, false},
+}
+
+func TestIdleMonitors(t *testing.T) {
+	for i, tt := range idleMonitorsTestTable {
+		idle, locked, err := tt.monitors.Idle(context.Background())
+		if idle != tt.idle || locked != tt.locked || (err == nil) != tt.ok {
+			t.Errorf("%d: got %s, locked %t (%v), want %s, locked %t", i, idle, locked, err, tt.idle, tt.locked)
+		}
+	}
+}
+
+func TestTrackerActsWhenUserAway(t *testing.T) {
+	o := trackerTestOptions
+	o.IdleAfter = 10
+	defer withOptions(o)()
+
+	// Active just now; the foreground Spotify is left alone.
+	tr, player, events := newTestTracker(StateForeground)
+	tr.poller.idle = fakeIdle{idle: time.Minute}
+	observeCpu(t, tr, Process{Pid: "1", Command: "Spotify"}, 20, 20, 20, 20, 20)
+	if len(*events) != 0 || len(player.calls) != 0 {
+		t.Errorf("active: got events %v, calls %v", events.types(), player.calls)
+	}
+
+	// Gone for a while; it's told to quit as soon as the window fills.
+	for _, idle := range []IdleMonitor{fakeIdle{idle: time.Hour}, fakeIdle{locked: true}} {
+		tr, player, events := newTestTracker(StateForeground)
+		tr.poller.idle = idle
+		observeCpu(t, tr, Process{Pid: "1", Command: "Spotify"}, 20, 20, 20)
+		want := []EventType{EventClosing}
+		if !reflect.DeepEqual(events.types(), want) || !reflect.DeepEqual(player.calls, []string{"quit"}) {
+			t.Errorf("away (%+v): got events %v, calls %v, want %v", idle, events.types(), player.calls, want)
+		}
+	}
+}
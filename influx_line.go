@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxPrecisionUnits are the durations of InfluxDB's timestamp precisions.
+var influxPrecisionUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"u":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// lineProtocol encodes a point in InfluxDB's line protocol, with its timestamp
+// in the given precision, e.g. "process,command=Spotify cpu=12.5,threads=40i 1479669535".
+func lineProtocol(p metricPoint, precision string) (string, error) {
+	if len(p.Fields) == 0 {
+		return "", fmt.Errorf("%q point has no fields", p.Name)
+	}
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(p.Name))
+	for _, k := range sortedKeys(p.Tags) {
+		if v := p.Tags[k]; v != "" {
+			b.WriteString("," + keyEscaper.Replace(k) + "=" + keyEscaper.Replace(v))
+		}
+	}
+	fields := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	for i, k := range fields {
+		if i == 0 {
+			b.WriteString(" ")
+		} else {
+			b.WriteString(",")
+		}
+		b.WriteString(keyEscaper.Replace(k) + "=")
+		switch v := p.Fields[k].(type) {
+		case float64:
+			b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		case int:
+			b.WriteString(strconv.Itoa(v) + "i")
+		case int64:
+			b.WriteString(strconv.FormatInt(v, 10) + "i")
+		case uint64:
+			b.WriteString(strconv.FormatUint(v, 10) + "i")
+		case bool:
+			b.WriteString(strconv.FormatBool(v))
+		case string:
+			b.WriteString(`"` + stringEscaper.Replace(v) + `"`)
+		default:
+			return "", fmt.Errorf("%q point has field %s of unsupported type %T", p.Name, k, v)
+		}
+	}
+	b.WriteString(" " + strconv.FormatInt(p.Time.UnixNano()/int64(influxPrecisionUnits[precision]), 10))
+	return b.String(), nil
+}
+
+func sortedKeys(tags metricTags) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// lineProtocolLines encodes the points, skipping (but reporting) any that can't
+// be encoded.
+func lineProtocolLines(points []metricPoint, precision string) (lines []string, err error) {
+	for _, p := range points {
+		line, e := lineProtocol(p, precision)
+		if e != nil {
+			err = e
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return
+}
+
+// influxV2 writes points to InfluxDB 2.x, through its write API, authenticating
+// with a token. Implements pointWriter.
+type influxV2 struct {
+	url    string
+	token  string
+	client *http.Client
+	config influxConfig
+}
+
+// newInfluxV2 returns a writer to the config's org and bucket. The password is
+// taken to be the token.
+func newInfluxV2(config influxConfig) (*influxV2, error) {
+	if config.Precision == "m" || config.Precision == "h" {
+		return nil, fmt.Errorf("InfluxDB 2.x doesn't support %q precision", config.Precision)
+	}
+	precision := config.Precision
+	if precision == "u" {
+		precision = "us"
+	}
+	query := url.Values{"org": {config.Org}, "bucket": {config.Bucket}, "precision": {precision}}
+	tlsConfig := config.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.InsecureSkipVerify = config.InsecureSkipVerify
+	return &influxV2{
+		url:   strings.TrimRight(config.Addr, "/") + "/api/v2/write?" + query.Encode(),
+		token: config.Password,
+		client: &http.Client{
+			Timeout:   config.Timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		config: config,
+	}, nil
+}
+
+func (w *influxV2) WritePoints(points []metricPoint) error {
+	lines, err := lineProtocolLines(points, w.config.Precision)
+	if err != nil {
+		log.Println("Dropping bad metrics point:", err)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	req, err := http.NewRequest("POST", w.url, strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+w.token)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// udpPayloadSize is the most we send in a single datagram, as InfluxDB's UDP
+// listener and StatsD both suggest.
+const udpPayloadSize = 512
+
+// influxUDP writes points to InfluxDB's UDP listener, in line protocol. There's
+// no telling whether they arrive. Implements pointWriter.
+type influxUDP struct {
+	conn      net.Conn
+	precision string
+}
+
+// newInfluxUDP returns a writer to the config's address, e.g. udp://localhost:8089.
+func newInfluxUDP(config influxConfig) (*influxUDP, error) {
+	conn, err := net.Dial("udp", strings.TrimPrefix(config.Addr, "udp://"))
+	if err != nil {
+		return nil, err
+	}
+	return &influxUDP{conn: conn, precision: config.Precision}, nil
+}
+
+func (w *influxUDP) WritePoints(points []metricPoint) error {
+	lines, err := lineProtocolLines(points, w.precision)
+	if err != nil {
+		log.Println("Dropping bad metrics point:", err)
+	}
+	return writeDatagrams(w.conn, lines)
+}
+
+// writeDatagrams sends the lines, newline terminated, in as few datagrams as
+// fit them.
+func writeDatagrams(conn net.Conn, lines []string) error {
+	var payload bytes.Buffer
+	for _, line := range lines {
+		if payload.Len() > 0 && payload.Len()+len(line)+1 > udpPayloadSize {
+			if _, err := conn.Write(payload.Bytes()); err != nil {
+				return err
+			}
+			payload.Reset()
+		}
+		payload.WriteString(line + "\n")
+	}
+	if payload.Len() > 0 {
+		_, err := conn.Write(payload.Bytes())
+		return err
+	}
+	return nil
+}
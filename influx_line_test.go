@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var lineProtocolTestTable = []struct {
+	point     metricPoint
+	precision string
+	line      string
+}{
+	{
+		metricPoint{"process", metricTags{"command": "Spotify Helper", "pid": "42", "power": ""},
+			metricFields{"cpu": 12.5, "threads": 40, "state": `say "hi"`, "closing": false}, time.Unix(1479669535, 0)},
+		"s",
+		`process,command=Spotify\ Helper,pid=42 closing=false,cpu=12.5,state="say \"hi\"",threads=40i 1479669535`,
+	},
+	{
+		metricPoint{"tracker", nil, metricFields{"state_errors": int64(3), "median": 8.0}, time.Unix(1, 500)},
+		"ns",
+		`tracker median=8,state_errors=3i 1000000500`,
+	},
+	{
+		metricPoint{"a,b c", metricTags{"k=1": "v,2"}, metricFields{"f": 1.5}, time.Unix(0, 1500000)},
+		"ms",
+		`a\,b\ c,k\=1=v\,2 f=1.5 1`,
+	},
+}
+
+func TestLineProtocol(t *testing.T) {
+	for _, tt := range lineProtocolTestTable {
+		line, err := lineProtocol(tt.point, tt.precision)
+		if err != nil || line != tt.line {
+			t.Errorf("got %s (%v), want %s", line, err, tt.line)
+		}
+	}
+	if _, err := lineProtocol(metricPoint{Name: "empty"}, "s"); err == nil {
+		t.Error("expected error for a point without fields")
+	}
+}
+
+func TestInfluxV2(t *testing.T) {
+	var got *http.Request
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		got, body = r, string(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	config := influxConfig{Org: "home", Bucket: "spotify", Precision: "u"}
+	config.Addr = server.URL
+	config.Password = "s3cret"
+	agent, err := newInfluxAgent(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := agent.(*influxV2); !ok {
+		t.Fatalf("got %T, want InfluxDB 2.x with a bucket", agent)
+	}
+	points := []metricPoint{
+		{"tracker", metricTags{"target": "Spotify"}, metricFields{"median": 1.5}, time.Unix(2, 0)},
+		{"metrics", nil, metricFields{"queued": int64(0)}, time.Unix(2, 0)},
+	}
+	if err := agent.WritePoints(points); err != nil {
+		t.Fatal(err)
+	}
+	if got.URL.Path != "/api/v2/write" || got.URL.Query().Get("org") != "home" ||
+		got.URL.Query().Get("bucket") != "spotify" || got.URL.Query().Get("precision") != "us" {
+		t.Errorf("unexpected request: %s", got.URL)
+	}
+	if auth := got.Header.Get("Authorization"); auth != "Token s3cret" {
+		t.Errorf("got Authorization %q", auth)
+	}
+	if want := "tracker,target=Spotify median=1.5 2000000\nmetrics queued=0i 2000000"; body != want {
+		t.Errorf("got body %q, want %q", body, want)
+	}
+}
+
+func TestInfluxV2Error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"code":"unauthorized"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	config := influxConfig{Org: "home", Bucket: "spotify", Precision: "s"}
+	config.Addr = server.URL
+	agent, err := newInfluxAgent(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = agent.WritePoints([]metricPoint{{"tracker", nil, metricFields{"median": 1.5}, time.Now()}})
+	if err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("got %v, want unauthorized error", err)
+	}
+}
+
+func TestInfluxUDP(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	config := influxConfig{Precision: "s"}
+	config.Addr = "udp://" + listener.LocalAddr().String()
+	agent, err := newInfluxAgent(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := agent.(*influxUDP); !ok {
+		t.Fatalf("got %T, want UDP for a udp:// address", agent)
+	}
+	// Enough points to need more than one datagram.
+	var points []metricPoint
+	for i := 0; i < 20; i++ {
+		points = append(points, metricPoint{"process", metricTags{"command": "Spotify Helper (renderer)"}, metricFields{"cpu": 1.5, "pageins": i}, time.Unix(3, 0)})
+	}
+	if err := agent.WritePoints(points); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	buf := make([]byte, 64*1024)
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(lines) < len(points) {
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got %d lines: %v", len(lines), err)
+		}
+		if n > udpPayloadSize {
+			t.Errorf("got a %d byte datagram, want at most %d", n, udpPayloadSize)
+		}
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(buf[:n]), "\n"), "\n")...)
+	}
+	if want := `process,command=Spotify\ Helper\ (renderer) cpu=1.5,pageins=19i 3`; lines[19] != want {
+		t.Errorf("got %s, want %s", lines[19], want)
+	}
+}
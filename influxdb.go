@@ -1,44 +1,125 @@
 package main
 
 import (
-	// "log"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/influxdata/influxdb/client/v2"
 )
 
-type metricTags map[string]string
-type metricFields map[string]interface{}
+// influxConfig is where and how to write metrics to InfluxDB.
+type influxConfig struct {
+	client.HTTPConfig
+	Database        string
+	RetentionPolicy string
+	Precision       string
+	Org             string // For 2.x, along with the bucket.
+	Bucket          string
+}
+
+// influxPrecisions are the timestamp precisions InfluxDB accepts. The client
+// takes microseconds as "us", though InfluxDB also calls them "u".
+var influxPrecisions = []string{"ns", "us", "ms", "s", "m", "h"}
 
+// influxConfigFromOptions returns the InfluxDB config given by the options and
+// the environment. The username may come from $INFLUX_USERNAME, and the
+// password from $INFLUX_PASSWORD or a file. For 2.x, the password is the token,
+// and may also come from $INFLUX_TOKEN.
+func influxConfigFromOptions() (c influxConfig, err error) {
+	c.Addr = opts.Influx
+	c.Database = opts.InfluxDatabase
+	c.RetentionPolicy = opts.InfluxRetention
+	c.Org = opts.InfluxOrg
+	c.Bucket = opts.InfluxBucket
+	c.Timeout = time.Duration(opts.InfluxWait) * time.Second
+	c.Username = opts.InfluxUser
+	if c.Username == "" {
+		c.Username = os.Getenv("INFLUX_USERNAME")
+	}
+	c.Password = os.Getenv("INFLUX_PASSWORD")
+	if token := os.Getenv("INFLUX_TOKEN"); token != "" && c.Bucket != "" {
+		c.Password = token
+	}
+	if opts.InfluxPasswordFile != "" {
+		data, err := ioutil.ReadFile(expandHome(opts.InfluxPasswordFile))
+		if err != nil {
+			return c, err
+		}
+		c.Password = strings.TrimSpace(string(data))
+	}
+	c.InsecureSkipVerify = opts.InfluxInsecure
+	if opts.InfluxCA != "" {
+		pem, err := ioutil.ReadFile(expandHome(opts.InfluxCA))
+		if err != nil {
+			return c, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return c, fmt.Errorf("no certificates found in %s", opts.InfluxCA)
+		}
+		c.TLSConfig = &tls.Config{RootCAs: pool}
+	}
+	c.Precision = opts.InfluxPrecision
+	if c.Precision == "u" {
+		c.Precision = "us"
+	}
+	for _, p := range influxPrecisions {
+		if c.Precision == p {
+			return c, nil
+		}
+	}
+	return c, fmt.Errorf("invalid precision %q, expected ns, us, ms, s, m or h", opts.InfluxPrecision)
+}
+
+// influxAgent writes metrics to InfluxDB.
 type influxAgent struct {
-	client.Client
+	client client.Client
+	config influxConfig
 }
 
-func newInfluxAgent() *influxAgent {
-	c, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr: "http://localhost:8086",
-	})
+// newInfluxAgent connects to InfluxDB, unless no address is configured, in which
+// case metrics are disabled and the agent is nil. A udp:// address gets line
+// protocol over UDP, and a bucket gets the 2.x write API. Otherwise, it's the
+// 1.x HTTP API.
+func newInfluxAgent(config influxConfig) (pointWriter, error) {
+	switch {
+	case config.Addr == "":
+		return nil, nil
+	case strings.HasPrefix(config.Addr, "udp://"):
+		return newInfluxUDP(config)
+	case config.Bucket != "":
+		return newInfluxV2(config)
+	}
+	c, err := client.NewHTTPClient(config.HTTPConfig)
 	if err != nil {
-		// log.Fatal(err)
+		return nil, err
 	}
-	return &influxAgent{c}
+	return &influxAgent{client: c, config: config}, nil
 }
 
-func (self *influxAgent) NewBatch() client.BatchPoints {
+// WritePoints writes a batch of points. Implements pointWriter.
+func (self *influxAgent) WritePoints(points []metricPoint) error {
 	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  "spotify",
-		Precision: "ns",
+		Database:        self.config.Database,
+		RetentionPolicy: self.config.RetentionPolicy,
+		Precision:       self.config.Precision,
 	})
 	if err != nil {
-		// log.Fatal(err)
+		return err
 	}
-	return bp
-}
-
-func (self *influxAgent) AddPoint(bp client.BatchPoints, name string, tags metricTags, fields metricFields) {
-	pt, err := client.NewPoint(name, nil, fields, time.Now())
-	if err != nil {
-		// log.Fatal(err)
+	for _, p := range points {
+		pt, err := client.NewPoint(p.Name, p.Tags, p.Fields, p.Time)
+		if err != nil {
+			log.Printf("Dropping bad %q metrics point: %v\n", p.Name, err)
+			continue
+		}
+		bp.AddPoint(pt)
 	}
-	bp.AddPoint(pt)
+	return self.client.Write(bp)
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInfluxConfigFromOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("INFLUX_USERNAME")
+	defer os.Unsetenv("INFLUX_PASSWORD")
+	os.Setenv("INFLUX_USERNAME", "spotify")
+	os.Setenv("INFLUX_PASSWORD", "from-env")
+
+	defer withOptions(options{
+		Influx:          "https://influx:8086",
+		InfluxDatabase:  "music",
+		InfluxRetention: "week",
+		InfluxWait:      3,
+		InfluxPrecision: "us",
+	})()
+	c, err := influxConfigFromOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Addr != "https://influx:8086" || c.Database != "music" || c.RetentionPolicy != "week" ||
+		c.Timeout != 3*time.Second || c.Precision != "us" {
+		t.Errorf("unexpected config: %+v", c)
+	}
+	if c.Username != "spotify" || c.Password != "from-env" {
+		t.Errorf("got credentials %q/%q from the environment", c.Username, c.Password)
+	}
+
+	opts.InfluxUser = "admin"
+	opts.InfluxPasswordFile = passwordFile
+	if c, err = influxConfigFromOptions(); err != nil || c.Username != "admin" || c.Password != "hunter2" {
+		t.Errorf("got credentials %q/%q (%v), want them from the options", c.Username, c.Password, err)
+	}
+
+	opts.InfluxCA = passwordFile
+	if _, err = influxConfigFromOptions(); err == nil {
+		t.Error("expected error for a CA file without certificates")
+	}
+	opts.InfluxCA = ""
+	opts.InfluxPrecision = "fortnight"
+	if _, err = influxConfigFromOptions(); err == nil {
+		t.Error("expected error for an invalid precision")
+	}
+}
+
+func TestInfluxAgentDisabled(t *testing.T) {
+	if metrics, err := newInfluxAgent(influxConfig{}); metrics != nil || err != nil {
+		t.Errorf("got %v (%v), want no agent without an address", metrics, err)
+	}
+}
+
+func TestInfluxAgentPrecisions(t *testing.T) {
+	var precision string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		precision = r.URL.Query().Get("precision")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	points := []metricPoint{{"tracker", metricTags{"target": "Spotify"}, metricFields{"median": 1.5}, time.Unix(2, 0)}}
+	defer withOptions(options{Influx: server.URL, InfluxDatabase: "music"})()
+	for _, p := range append(influxPrecisions, "u") {
+		opts.InfluxPrecision = p
+		config, err := influxConfigFromOptions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		agent, err := newInfluxAgent(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		precision = ""
+		if err := agent.WritePoints(points); err != nil {
+			t.Errorf("%s: %v", p, err)
+		} else if precision != config.Precision {
+			t.Errorf("%s: wrote with precision %q, want %q", p, precision, config.Precision)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// InterventionLimiter keeps a history of interventions (quits, kills, throttles)
+// per target, so that we stop acting on a target that keeps misbehaving, rather
+// than killing it every few minutes forever. The history is saved to a file, to
+// survive a restart.
+type InterventionLimiter struct {
+	path    string
+	max     int
+	window  time.Duration
+	targets map[string]*interventionHistory
+}
+
+type interventionHistory struct {
+	Interventions []time.Time `json:"interventions"`
+	LockedOut     bool        `json:"locked_out,omitempty"`
+}
+
+// LoadInterventionLimiter reads the history from path, if it exists. A target
+// may be intervened on at most max times in the window, or without limit if max
+// is zero.
+func LoadInterventionLimiter(path string, max int, window time.Duration) (*InterventionLimiter, error) {
+	l := &InterventionLimiter{path: path, max: max, window: window, targets: make(map[string]*interventionHistory)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &l.targets); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *InterventionLimiter) history(target string) *interventionHistory {
+	h, ok := l.targets[target]
+	if !ok {
+		h = &interventionHistory{}
+		l.targets[target] = h
+	}
+	return h
+}
+
+// Count returns the number of interventions on the target within the window.
+func (l *InterventionLimiter) Count(target string, now time.Time) (n int) {
+	for _, t := range l.history(target).Interventions {
+		if now.Sub(t) < l.window {
+			n += 1
+		}
+	}
+	return
+}
+
+// Allow returns whether we may intervene on the target again.
+func (l *InterventionLimiter) Allow(target string, now time.Time) bool {
+	if l.LockedOut(target) {
+		return false
+	}
+	return l.max <= 0 || l.Count(target, now) < l.max
+}
+
+// Record notes an intervention on the target, forgetting those that have
+// fallen out of the window.
+func (l *InterventionLimiter) Record(target string, now time.Time) error {
+	h := l.history(target)
+	var recent []time.Time
+	for _, t := range h.Interventions {
+		if now.Sub(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+	h.Interventions = append(recent, now)
+	return l.save()
+}
+
+// LockOut marks the target to be kept closed, until Reset.
+func (l *InterventionLimiter) LockOut(target string) error {
+	l.history(target).LockedOut = true
+	return l.save()
+}
+
+// LockedOut returns whether the target is to be kept closed.
+func (l *InterventionLimiter) LockedOut(target string) bool {
+	return l.history(target).LockedOut
+}
+
+// Reset forgets all history, for all targets.
+func (l *InterventionLimiter) Reset() error {
+	l.targets = make(map[string]*interventionHistory)
+	return l.save()
+}
+
+// save writes the history to a temporary file first, so we never leave behind a
+// partially written one. Without a path, the history is only kept in memory.
+func (l *InterventionLimiter) save() error {
+	if l.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(l.targets, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(l.path), ".spotifywatcher")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), l.path)
+}
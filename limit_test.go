@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempStatePath(t *testing.T) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "limit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "state.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestInterventionLimiterWindow(t *testing.T) {
+	path, cleanup := tempStatePath(t)
+	defer cleanup()
+
+	l, err := LoadInterventionLimiter(path, 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2016, 12, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		now := start.Add(time.Duration(i) * 10 * time.Minute)
+		if !l.Allow("Spotify", now) {
+			t.Fatalf("action %d should be allowed", i+1)
+		}
+		if err := l.Record("Spotify", now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if l.Allow("Spotify", start.Add(30*time.Minute)) {
+		t.Error("4th action within the hour should not be allowed")
+	}
+	if !l.Allow("Other", start.Add(30*time.Minute)) {
+		t.Error("limits should be per target")
+	}
+	// The first action falls out of the window.
+	if !l.Allow("Spotify", start.Add(61*time.Minute)) {
+		t.Error("action should be allowed once the window has passed")
+	}
+}
+
+func TestInterventionLimiterSurvivesRestart(t *testing.T) {
+	path, cleanup := tempStatePath(t)
+	defer cleanup()
+
+	now := time.Now()
+	l, err := LoadInterventionLimiter(path, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Record("Spotify", now)
+	l.Record("Spotify", now)
+	l.LockOut("Spotify")
+
+	l, err = LoadInterventionLimiter(path, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := l.Count("Spotify", now); n != 2 {
+		t.Errorf("got %d actions after reload, want 2", n)
+	}
+	if !l.LockedOut("Spotify") {
+		t.Error("lockout should survive reload")
+	}
+
+	if err := l.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = LoadInterventionLimiter(path, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.LockedOut("Spotify") || !l.Allow("Spotify", now) {
+		t.Error("reset should clear the lockout and history")
+	}
+}
+
+func TestInterventionLimiterUnlimited(t *testing.T) {
+	l, err := LoadInterventionLimiter("", 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		l.Record("Spotify", now)
+	}
+	if !l.Allow("Spotify", now) {
+		t.Error("no limit should always allow")
+	}
+}
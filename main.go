@@ -3,28 +3,119 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/aviddiviner/docopt-go"
 )
 
+const version = "0.3"
+
 var usage = `Monitor Spotify background CPU usage and kill it if it misbehaves.
 
 Usage:
-  SpotifyWatcher [-s SECONDS] [-t CPU] [-w LENGTH] [-n ALLOWED] [-f] [-q|-v]
+  SpotifyWatcher [options] [-q|-v] [--hook EVENT=CMD]... [--webhook-header HEADER]... [--otlp-header HEADER]...
+  SpotifyWatcher history [--from TIME] [--to TIME] [--history-dir DIR]
   SpotifyWatcher -h | --help | --version
 
 Options:
-  -s SECONDS    Interval in secs with which to poll 'top' [default: 4].
-  -t CPU        CPU threshold at which to kill Spotify [default: 8.0].
-  -w LENGTH     Median sample window size [default: 5].
-  -n ALLOWED    Max intervals exceeding threshold before killing [default: 20].
-  -f --force    Monitor CPU even if Spotify is the frontmost (active) window.
-  -q --quiet    Only output console message when Spotify is misbehaving.
-  -v --verbose  Show details of all matching Spotify processes each tick.
-  -h --help     Show this screen.
-  --version     Show version.`
+  -s SECONDS            Interval in secs with which to poll 'top' [default: 4].
+  -t CPU                CPU threshold at which to kill Spotify [default: 8.0].
+  -w LENGTH             Median sample window size [default: 5].
+  -n ALLOWED            Max intervals exceeding threshold before killing [default: 20].
+  -f --force            Monitor CPU even if Spotify is the frontmost (active) window.
+  -q --quiet            Only output console message when Spotify is misbehaving.
+  -v --verbose          Show details of all matching Spotify processes each tick.
+  --throttle            Limit Spotify's CPU with a cgroup instead of killing it (Linux).
+  --cgroup-root DIR     Root of the cgroup v2 hierarchy [default: /sys/fs/cgroup].
+  --player-wait SECS    Give up waiting on Spotify to respond [default: 2].
+  --unknown-state HOW   When we can't get Spotify's state, treat it as "foreground",
+                        "background", or "skip" the sample [default: background].
+  --dry-run             Only log what would be done, never quit or kill Spotify.
+  --hook EVENT=CMD      Run a shell command on an event (misbehaving, closing, killed,
+                        throttled, released, recovered, frozen, thawed, exited,
+                        giving-up or all).
+  --hook-timeout SECS   Kill hook commands that run for longer [default: 10].
+  --webhook URL         POST each event to URL, as a JSON document.
+  --webhook-header HEADER
+                        Extra "Name: value" header to send with webhook requests.
+  --webhook-body TMPL   Template for the webhook body, instead of the event JSON.
+  --webhook-retries N   Times to retry a failed webhook request [default: 3].
+  --max-actions N       Give up after quitting, killing or throttling Spotify this
+                        many times within the action window.
+  --action-window MINS  Window over which actions are limited [default: 60].
+  --lockout             Once we've given up, keep Spotify closed until --reset.
+  --reset               Forget all past actions, and any lockout.
+  --state FILE          Where to keep the history of actions, to survive restarts
+                        [default: ~/.spotifywatcher.json].
+  --idle-after MINS     Only let a frontmost Spotify be if we've been active within
+                        MINS; once idle or locked, act without allowing breaches.
+  --quit-paused MINS    Quit Spotify once it's been paused (or stopped) in the
+                        background for MINS, whatever its CPU.
+  --freeze-paused MINS  Freeze Spotify once it's been paused in the background for
+                        MINS, thawing it when it comes to the front or is played.
+  --control ADDR        Listen on ADDR (e.g. localhost:7117) for commands, such as
+                        POST /play or /thaw.
+  --prometheus ADDR     Listen on ADDR (e.g. :9117) for Prometheus to scrape
+                        /metrics.
+  --statsd ADDR         Send metrics to a StatsD agent at ADDR, e.g. localhost:8125.
+  --statsd-prefix P     Prefix for StatsD metric names [default: spotifywatcher].
+  --statsd-tags         Tag StatsD metrics, DogStatsD style, rather than naming
+                        them for the target and command.
+  --statsd-rate RATE    Sample rate for StatsD metrics, up to 1 [default: 1].
+  --otlp URL            Export metrics and events to an OpenTelemetry collector,
+                        e.g. http://localhost:4318.
+  --otlp-protocol P     Protocol to export with, "http/protobuf" or "grpc" (usually
+                        on port 4317) [default: http/protobuf].
+  --otlp-header HEADER  Extra "Name: value" header to send with OTLP requests.
+  --keep-history        Keep a local history of each tick and event, to be shown by
+                        the history command.
+  --history-dir DIR     Where to keep the history
+                        [default: ~/.spotifywatcher-history].
+  --history-raw DAYS    Keep every tick for DAYS, then only 5 minute summaries
+                        [default: 2].
+  --history-days DAYS   Forget history older than DAYS [default: 90].
+  --from TIME           Show history since TIME, as a date (2006-01-02), a date and
+                        time (2006-01-02T15:04), or how long ago (90m, 7d)
+                        [default: 24h].
+  --to TIME             Show history until TIME [default: now].
+  --export FILE         Write every process sample, tracker decision and event to
+                        FILE, for analysis elsewhere.
+  --format FMT          Format to export in, "csv" or "jsonl" [default: csv].
+  --export-gzip         Gzip the exported file.
+  --export-size MB      Start another export file once it reaches MB, or never if 0
+                        [default: 100].
+  --influx URL          Write metrics to InfluxDB at URL, e.g. http://localhost:8086,
+                        or udp://localhost:8089 for line protocol over UDP.
+  --influx-db NAME      Database to write metrics to [default: spotify].
+  --influx-rp NAME      Retention policy to write metrics with, if not the default.
+  --influx-org ORG      Organization to write metrics to, for InfluxDB 2.x.
+  --influx-bucket NAME  Bucket to write metrics to, for InfluxDB 2.x, instead of
+                        the database. The token is $INFLUX_TOKEN, or the password.
+  --influx-user USER    User to write metrics as, or $INFLUX_USERNAME. The password
+                        is $INFLUX_PASSWORD, or read from --influx-password-file.
+  --influx-password-file FILE
+                        File holding the InfluxDB password.
+  --influx-ca FILE      CA certificates to verify an https:// InfluxDB against.
+  --influx-insecure     Don't verify the InfluxDB server's certificate.
+  --influx-wait SECS    Give up on writing metrics after SECS [default: 5].
+  --influx-precision P  Timestamp precision: ns, us (or u), ms, s, m or h, though
+                        InfluxDB 2.x only takes ns to s [default: ns].
+  --metrics-batch N     Write metrics in batches of up to N points [default: 100].
+  --metrics-flush SECS  Write metrics at least every SECS [default: 10].
+  --metrics-spool DIR   Where to keep metrics that couldn't be written, until they
+                        can be [default: ~/.spotifywatcher-spool].
+  --metrics-spool-max N
+                        Keep at most N batches spooled, dropping the oldest
+                        [default: 1000].
+  -h --help             Show this screen.
+  --version             Show version.`
 
 type options struct {
 	TopInterval     int     `docopt:"-s"`
@@ -34,142 +125,227 @@ type options struct {
 	Quiet           bool
 	Force           bool
 	Verbose         bool
+	Throttle        bool
+	CgroupRoot      string
+	PlayerWait      int
+	UnknownState    string
+	DryRun          bool
+	Hook            []string
+	HookTimeout     int
+	Webhook         string
+	WebhookHeader   []string
+	WebhookBody     string
+	WebhookRetries  int
+	MaxActions      int
+	ActionWindow    int
+	Lockout         bool
+	Reset           bool
+	State           string
+	IdleAfter       int
+	QuitPaused      int
+	FreezePaused    int
+	Control         string
+	Prometheus      string
+	Statsd          string
+	StatsdPrefix    string
+	StatsdTags      bool
+	StatsdRate      float64
+	OTLP            string   `docopt:"--otlp"`
+	OTLPProtocol    string   `docopt:"--otlp-protocol"`
+	OTLPHeader      []string `docopt:"--otlp-header"`
+	KeepHistory     bool
+	HistoryDir      string
+	HistoryRaw      int
+	HistoryDays     int
+	History         bool // The history command.
+	From            string
+	To              string
+	Export          string
+	Format          string
+	ExportGzip      bool
+	ExportSize      int
+
+	Influx             string
+	InfluxDatabase     string `docopt:"--influx-db"`
+	InfluxRetention    string `docopt:"--influx-rp"`
+	InfluxOrg          string
+	InfluxBucket       string
+	InfluxUser         string
+	InfluxPasswordFile string
+	InfluxCA           string `docopt:"--influx-ca"`
+	InfluxInsecure     bool
+	InfluxWait         int
+	InfluxPrecision    string
+	MetricsBatch       int
+	MetricsFlush       int
+	MetricsSpool       string
+	MetricsSpoolMax    int
 }
 
 var opts options
 
-type tracker struct {
-	avgCpu   *FloatWindow
-	breaches int
-	closing  bool
-}
-
-func newTracker() *tracker {
-	return &tracker{avgCpu: NewFloatWindow(opts.WindowLength)}
-}
+// atExit leaves Spotify as we found it, before exiting on a fatal error.
+var atExit = func() {}
 
-func (t *tracker) reset() {
-	t.avgCpu.Reset()
-	t.breaches = 0
-	t.closing = false
+// fatal is log.Fatal, once Spotify has been let go.
+func fatal(v ...interface{}) {
+	atExit()
+	log.Fatal(v...)
 }
 
-func (t *tracker) CloseSpotify() error {
-	// We've told Spotify to close itself. Wait for it a bit, before erroring.
-	if t.closing {
-		if t.breaches < opts.AllowedBreaches+5 {
-			log.Println("Spotify is trying to close itself...")
-			t.breaches += 1
-			return nil
-		}
-		return fmt.Errorf("Spotify failed to close, must be forcibly killed")
+// expandHome replaces a leading "~/" in path with the user's home directory.
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
 	}
-	// Spotify hasn't been told to close, but it's now misbehaving.
-	if t.breaches < opts.AllowedBreaches {
-		log.Println("Spotify is misbehaving!")
-		t.breaches += 1
-		return nil
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatal(err)
 	}
-	log.Println("Okay, that's enough now. Closing Spotify.")
-	t.closing = true
-	return TellSpotifyToQuit()
+	return filepath.Join(home, path[2:])
 }
 
-func (t *tracker) Kill(p Process) error {
-	log.Println("Killing the Spotify process!")
-	pid, err := strconv.Atoi(p.Pid)
+func parseOptions(argv []string) (o options) {
+	args, _ := docopt.ParseArgs(usage, argv, version)
+	err := args.Bind(&o)
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-	return kill(pid)
-}
-
-func (t *tracker) spotifyState() State {
-	if t.closing {
-		return StateClosing
-	} else {
-		state, _ := SpotifyState()
-		return state
+	switch o.UnknownState {
+	case unknownAsForeground, unknownAsBackground, unknownSkipped:
+	default:
+		log.Fatalf("Invalid --unknown-state %q, expected foreground, background or skip", o.UnknownState)
 	}
+	return
 }
 
-func (t *tracker) Observe(p Process) error {
-	if p == (Process{}) {
-		// Nil process means no Spotify, so reset all counters and return.
-		t.reset()
-		return nil
+func main() {
+	opts = parseOptions(nil)
+	if opts.History {
+		if err := showHistory(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	cpu, err := strconv.ParseFloat(p.Cpu, 64)
+	log.Printf("Starting with options: %+v\n", opts)
+
+	player, err := newPlayer()
 	if err != nil {
-		return err
-	}
-	// Check state: foreground, background (playing/paused/etc).
-	state := t.spotifyState()
-	// Active in the foreground; ignore, unless forceful.
-	if state == StateForeground && !opts.Force {
-		if !opts.Quiet {
-			log.Printf("Spotify: foreground (ignored), CPU: %.2f\n", cpu)
+		log.Fatal(err)
+	}
+	tracker := newTracker(player)
+	atExit = tracker.Shutdown
+	if opts.IdleAfter > 0 {
+		idle, err := newIdleMonitor()
+		if err != nil {
+			log.Fatal(err)
 		}
-		return nil
+		tracker.poller.idle = idle
 	}
-
-	t.avgCpu.Append(cpu)
-	samples := t.avgCpu.Len()
-	median := t.avgCpu.Median()
-	if !opts.Quiet {
-		log.Printf("Spotify: %s, CPU: %.2f (%.2f median, samples: %d)\n", state, cpu, median, samples)
+	if opts.FreezePaused > 0 {
+		freezer, err := newFreezer()
+		if err != nil {
+			log.Fatal(err)
+		}
+		tracker.freezer = freezer
+		tracker.windows = newActiveWindow()
+		if tracker.windows == nil {
+			if opts.Control != "" {
+				log.Println("Warning: Can't tell when Spotify comes to the front, so once frozen, it's only thawed by POST /play or /thaw.")
+			} else {
+				log.Println("Warning: Can't tell when Spotify comes to the front, so once frozen, it stays frozen until it exits (or we do). Use --control to thaw it.")
+			}
+		}
 	}
-
-	// Take action if we have sufficient samples.
-	if samples == opts.WindowLength && median > opts.CpuThreshold {
-		if err := t.CloseSpotify(); err != nil {
-			return t.Kill(p)
+	tracker.poller.Start(time.Duration(opts.TopInterval) * time.Second)
+	if opts.Throttle {
+		throttler, err := newThrottler()
+		if err != nil {
+			log.Fatal(err)
 		}
+		tracker.throttler = throttler
 	}
-	return nil
-}
-
-func parseOptions(argv []string) (o options) {
-	args, _ := docopt.ParseArgs(usage, argv, "0.3")
-	err := args.Bind(&o)
+	var runner *HookRunner
+	if len(opts.Hook) > 0 {
+		var hooks []Hook
+		for _, spec := range opts.Hook {
+			hook, err := ParseHook(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			hooks = append(hooks, hook)
+		}
+		timeout := time.Duration(opts.HookTimeout) * time.Second
+		runner = NewHookRunner(hooks, timeout)
+		tracker.handlers = append(tracker.handlers, runner)
+	}
+	if opts.MaxActions > 0 || opts.Lockout || opts.Reset {
+		window := time.Duration(opts.ActionWindow) * time.Minute
+		limiter, err := LoadInterventionLimiter(expandHome(opts.State), opts.MaxActions, window)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if opts.DryRun {
+			limiter.path = "" // Dry runs mustn't count against live ones.
+		}
+		if opts.Reset {
+			if err := limiter.Reset(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		tracker.limiter = limiter
+	}
+	var webhook *Webhook
+	if opts.Webhook != "" {
+		webhook, err = NewWebhook(opts.Webhook, opts.WebhookHeader, opts.WebhookBody, opts.WebhookRetries)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tracker.handlers = append(tracker.handlers, webhook)
+	}
+	top := NewTop(opts.TopInterval)
+	sinks, err := newMetricSinks(top, runner)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return
-}
-
-func main() {
-	opts = parseOptions(nil)
-	log.Printf("Starting with options: %+v\n", opts)
-
-	metrics := newInfluxAgent()
-	tracker := newTracker()
-	top := NewTop(opts.TopInterval)
+	if len(sinks) > 0 {
+		tracker.handlers = append(tracker.handlers, sinks)
+	}
+	if opts.Control != "" {
+		go func() {
+			fatal(http.ListenAndServe(opts.Control, NewControl(tracker)))
+		}()
+	}
+	// Every point is tagged with what's watched, and where.
+	watchTags := metricTags{"target": spotifyCommand}
+	if host, err := os.Hostname(); err == nil {
+		watchTags["host"] = host
+	}
+	// Let Spotify go, see its last events through the hooks and webhook, and
+	// write (or spool) what's left of the metrics, when we're told to stop.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 	for {
 		select {
+		case <-stop:
+			tracker.Shutdown()
+			if runner != nil {
+				if err := runner.Close(); err != nil {
+					log.Println("Failed to run hooks:", err)
+				}
+			}
+			if webhook != nil {
+				if err := webhook.Close(); err != nil {
+					log.Println("Failed to send webhooks:", err)
+				}
+			}
+			if err := sinks.Close(); err != nil {
+				log.Println("Failed to close metrics:", err)
+			}
+			return
 		case <-top.NextTick:
 			var spotify Process
-			batch := metrics.NewBatch()
-			addMetricPoint := func(p Process) {
-				// TODO: Better Process struct, do this in parseTopLine() rather.
-				pid, _ := strconv.Atoi(p.Pid)
-				cpu, _ := strconv.ParseFloat(p.Cpu, 64)
-				threads, _ := strconv.Atoi(p.Threads)
-				pageins, _ := strconv.Atoi(p.Pageins)
-				metrics.AddPoint(batch, "process",
-					metricTags{
-						"command": p.Command,
-					},
-					metricFields{
-						"pid":     pid,
-						"cpu":     cpu,
-						"threads": threads,
-						"state":   p.State,
-						"time":    p.Time,
-						"pageins": pageins,
-						"command": p.Command,
-					})
-			}
+			var processes []Process
 			headerShown := false
 			showProcessLine := func(p Process) {
 				if !opts.Verbose {
@@ -182,19 +358,60 @@ func main() {
 				fmt.Printf("  %-6s %-4s %-5s %-8s %-8s %-8s %s\n", p.Pid, p.Cpu, p.Threads, p.State, p.Time, p.Pageins, p.Command)
 			}
 			for _, p := range top.ProcessList() {
-				if strings.HasPrefix(p.Command, "Spotify") {
+				if strings.HasPrefix(p.Command, spotifyCommand) {
 					showProcessLine(p)
-					addMetricPoint(p)
-					if p.Command == "Spotify" {
+					processes = append(processes, p)
+					if p.Command == spotifyCommand {
 						spotify = p
 					}
 				}
 			}
-			if err := metrics.Write(batch); err != nil {
-				// log.Fatal(err)
-			}
 			if err := tracker.Observe(spotify); err != nil {
-				log.Fatal(err)
+				fatal(err)
+			}
+
+			if len(sinks) == 0 {
+				continue
+			}
+			// Tag everything with what the tracker made of this tick.
+			now := time.Now()
+			trackerTags, trackerFields := tracker.Metrics()
+			for k, v := range watchTags {
+				trackerTags[k] = v
+			}
+			if power := powerSource(); power != "" {
+				trackerTags["power"] = power
+			}
+			sinks.BeginTick(now)
+			sinks.AddTracker(metricPoint{"tracker", trackerTags, trackerFields, now})
+			track := tracker.poller.Track()
+			for _, p := range processes {
+				// TODO: Better Process struct, do this in parseTopLine() rather.
+				cpu, _ := strconv.ParseFloat(p.Cpu, 64)
+				threads, _ := strconv.Atoi(p.Threads)
+				pageins, _ := strconv.Atoi(p.Pageins)
+				fields := metricFields{
+					"cpu":     cpu,
+					"threads": threads,
+					"state":   p.State,
+					"time":    p.Time,
+					"pageins": pageins,
+				}
+				tags := metricTags{"command": p.Command, "pid": p.Pid}
+				for k, v := range trackerTags {
+					tags[k] = v
+				}
+				if track != (Track{}) {
+					fields["track_name"] = track.Name
+					fields["track_artist"] = track.Artist
+					fields["track_album"] = track.Album
+					fields["track_uri"] = track.URI
+					tags["track_kind"] = track.Kind()
+				}
+				sinks.AddProcess(metricPoint{"process", tags, fields, now})
+			}
+			if err := sinks.Flush(); err != nil {
+				log.Println("Failed to write metrics:", err)
 			}
 		}
 	}
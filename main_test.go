@@ -8,6 +8,48 @@ import (
 	"github.com/aviddiviner/docopt-go"
 )
 
+// defaultOptions are the options given nothing but their defaults.
+var defaultOptions = options{
+	TopInterval:     4,
+	CpuThreshold:    8.0,
+	WindowLength:    5,
+	AllowedBreaches: 20,
+	CgroupRoot:      "/sys/fs/cgroup",
+	PlayerWait:      2,
+	UnknownState:    "background",
+	Hook:            []string{},
+	HookTimeout:     10,
+	WebhookHeader:   []string{},
+	WebhookRetries:  3,
+	ActionWindow:    60,
+	State:           "~/.spotifywatcher.json",
+	StatsdPrefix:    "spotifywatcher",
+	StatsdRate:      1,
+	OTLPProtocol:    "http/protobuf",
+	OTLPHeader:      []string{},
+	HistoryDir:      "~/.spotifywatcher-history",
+	HistoryRaw:      2,
+	HistoryDays:     90,
+	From:            "24h",
+	To:              "now",
+	Format:          "csv",
+	ExportSize:      100,
+	InfluxDatabase:  "spotify",
+	InfluxWait:      5,
+	InfluxPrecision: "ns",
+	MetricsBatch:    100,
+	MetricsFlush:    10,
+	MetricsSpool:    "~/.spotifywatcher-spool",
+	MetricsSpoolMax: 1000,
+}
+
+// withDefaults returns the default options, with the given changes.
+func withDefaults(change func(o *options)) options {
+	o := defaultOptions
+	change(&o)
+	return o
+}
+
 // List of test cases
 var usageTestTable = []struct {
 	argv string  // Given command line args
@@ -15,15 +57,138 @@ var usageTestTable = []struct {
 }{
 	{
 		"-s 5 -t 3 -w6 -n 7 -f -v",
-		options{
-			TopInterval:     5,
-			CpuThreshold:    3.0,
-			WindowLength:    6,
-			AllowedBreaches: 7,
-			Quiet:           false,
-			Force:           true,
-			Verbose:         true,
-		},
+		withDefaults(func(o *options) {
+			o.TopInterval = 5
+			o.CpuThreshold = 3.0
+			o.WindowLength = 6
+			o.AllowedBreaches = 7
+			o.Quiet = false
+			o.Force = true
+			o.Verbose = true
+		}),
+	},
+	{
+		"-q --throttle --cgroup-root /tmp/cgroup",
+		withDefaults(func(o *options) {
+			o.Quiet = true
+			o.Throttle = true
+			o.CgroupRoot = "/tmp/cgroup"
+		}),
+	},
+	{
+		"--player-wait 5 --unknown-state skip",
+		withDefaults(func(o *options) {
+			o.PlayerWait = 5
+			o.UnknownState = "skip"
+		}),
+	},
+	{
+		"--dry-run",
+		withDefaults(func(o *options) {
+			o.DryRun = true
+		}),
+	},
+	{
+		"--hook killed=echo_bye --hook all=logger --hook-timeout 5",
+		withDefaults(func(o *options) {
+			o.Hook = []string{"killed=echo_bye", "all=logger"}
+			o.HookTimeout = 5
+		}),
+	},
+	{
+		"--webhook http://localhost/hook --webhook-header X-Token:abc --webhook-retries 1",
+		withDefaults(func(o *options) {
+			o.Webhook = "http://localhost/hook"
+			o.WebhookHeader = []string{"X-Token:abc"}
+			o.WebhookRetries = 1
+		}),
+	},
+	{
+		"--max-actions 3 --action-window 30 --lockout --state /tmp/state.json",
+		withDefaults(func(o *options) {
+			o.MaxActions = 3
+			o.ActionWindow = 30
+			o.Lockout = true
+			o.State = "/tmp/state.json"
+		}),
+	},
+	{
+		"--idle-after 10",
+		withDefaults(func(o *options) {
+			o.IdleAfter = 10
+		}),
+	},
+	{
+		"--quit-paused 30",
+		withDefaults(func(o *options) {
+			o.QuitPaused = 30
+		}),
+	},
+	{
+		"--freeze-paused 15 --control localhost:7117",
+		withDefaults(func(o *options) {
+			o.FreezePaused = 15
+			o.Control = "localhost:7117"
+		}),
+	},
+	{
+		"--influx http://localhost:8086 --influx-rp week --influx-precision s",
+		withDefaults(func(o *options) {
+			o.Influx = "http://localhost:8086"
+			o.InfluxRetention = "week"
+			o.InfluxPrecision = "s"
+		}),
+	},
+	{
+		"--prometheus :9117",
+		withDefaults(func(o *options) {
+			o.Prometheus = ":9117"
+		}),
+	},
+	{
+		"--statsd localhost:8125 --statsd-tags --statsd-rate 0.5",
+		withDefaults(func(o *options) {
+			o.Statsd = "localhost:8125"
+			o.StatsdTags = true
+			o.StatsdRate = 0.5
+		}),
+	},
+	{
+		"--otlp http://localhost:4318 --otlp-header X-Scope:home",
+		withDefaults(func(o *options) {
+			o.OTLP = "http://localhost:4318"
+			o.OTLPHeader = []string{"X-Scope:home"}
+		}),
+	},
+	{
+		"--otlp http://localhost:4317 --otlp-protocol grpc",
+		withDefaults(func(o *options) {
+			o.OTLP = "http://localhost:4317"
+			o.OTLPProtocol = "grpc"
+		}),
+	},
+	{
+		"--keep-history --history-raw 7",
+		withDefaults(func(o *options) {
+			o.KeepHistory = true
+			o.HistoryRaw = 7
+		}),
+	},
+	{
+		"history --from 7d --history-dir /tmp/history",
+		withDefaults(func(o *options) {
+			o.History = true
+			o.From = "7d"
+			o.HistoryDir = "/tmp/history"
+		}),
+	},
+	{
+		"--export ~/samples.jsonl.gz --format jsonl --export-gzip",
+		withDefaults(func(o *options) {
+			o.Export = "~/samples.jsonl.gz"
+			o.Format = "jsonl"
+			o.ExportGzip = true
+		}),
 	},
 }
 
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type metricTags map[string]string
+type metricFields map[string]interface{}
+
+// metricPoint is a single measurement, on its way to being written.
+type metricPoint struct {
+	Name   string
+	Tags   metricTags
+	Fields metricFields
+	Time   time.Time
+}
+
+// pointWriter writes a batch of points somewhere, such as InfluxDB.
+type pointWriter interface {
+	WritePoints(points []metricPoint) error
+}
+
+// metricsQueueSize is how many ticks' worth of points may wait to be batched,
+// before we start dropping them.
+const metricsQueueSize = 64
+
+// MetricsQueue writes points in the background, so that the tick loop never
+// waits on the metrics server. Points are batched across ticks, and written
+// once there are enough of them, or often enough. Failed writes are retried
+// with exponential backoff, and if they still fail, the batch is spooled to
+// disk, to be written once the server is back. Closing cuts the retries short.
+type MetricsQueue struct {
+	writer   pointWriter
+	spool    *metricsSpool // Optional.
+	batch    int
+	interval time.Duration
+	retries  int
+	backoff  time.Duration
+	queue    chan []metricPoint
+	flushed  chan struct{} // For tests, signalled after each flush.
+	done     chan struct{} // Closed once the queue is closed and flushed.
+
+	mu      sync.Mutex    // Guards closed, so nothing's queued once it's closed.
+	closed  bool
+	closing chan struct{} // Closed as soon as the queue is, to stop retrying.
+
+	queued  int64 // Points waiting, in memory or spooled.
+	dropped uint64
+	failing bool
+}
+
+// NewMetricsQueue starts writing points to w, in batches of up to batch points,
+// at least every interval. If spool is given, that's where batches are kept
+// until they can be written.
+func NewMetricsQueue(w pointWriter, spool *metricsSpool, batch int, interval time.Duration) *MetricsQueue {
+	q := &MetricsQueue{
+		writer:   w,
+		spool:    spool,
+		batch:    batch,
+		interval: interval,
+		retries:  3,
+		backoff:  time.Second,
+		queue:    make(chan []metricPoint, metricsQueueSize),
+		done:     make(chan struct{}),
+		closing:  make(chan struct{}),
+	}
+	if spool != nil {
+		atomic.AddInt64(&q.queued, int64(spool.Points()))
+	}
+	go q.process()
+	return q
+}
+
+// Add queues the points to be written. If the queue is full, or closed, they're
+// dropped.
+func (q *MetricsQueue) Add(points ...metricPoint) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		atomic.AddUint64(&q.dropped, uint64(len(points)))
+		return
+	}
+	select {
+	case q.queue <- points:
+		atomic.AddInt64(&q.queued, int64(len(points)))
+	default:
+		if atomic.AddUint64(&q.dropped, uint64(len(points))) == uint64(len(points)) {
+			log.Println("Metrics are falling behind, dropping points.")
+		}
+	}
+}
+
+// WritePoints queues a tick's points, along with a "metrics" point counting the
+// points queued and dropped so far, tagged with the target and host of the
+// first of them. Implements pointWriter, so the queue can stand in for its
+// writer.
+func (q *MetricsQueue) WritePoints(points []metricPoint) error {
+	if len(points) > 0 {
+		tags := metricTags{}
+		for _, k := range []string{"target", "host"} {
+			if v, ok := points[0].Tags[k]; ok {
+				tags[k] = v
+			}
+		}
+		points = append(points[:len(points):len(points)], metricPoint{"metrics", tags, metricFields{
+			"queued":  q.Queued(),
+			"dropped": int64(q.Dropped()),
+		}, points[0].Time})
+	}
+	q.Add(points...)
+	return nil
+}
+
+// Close writes (or spools) whatever is queued, without retrying, and stops.
+// Points added after it's closed are dropped.
+func (q *MetricsQueue) Close() error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.closing)
+		close(q.queue)
+	}
+	q.mu.Unlock()
+	<-q.done
+	return nil
+}
+
+// Queued returns the number of points waiting to be written, in memory or
+// spooled to disk.
+func (q *MetricsQueue) Queued() int64 {
+	return atomic.LoadInt64(&q.queued)
+}
+
+// Dropped returns the number of points which were given up on.
+func (q *MetricsQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+func (q *MetricsQueue) process() {
+	var pending []metricPoint
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case points, ok := <-q.queue:
+			if !ok {
+				q.flush(pending)
+				close(q.done)
+				return
+			}
+			pending = append(pending, points...)
+			if len(pending) < q.batch {
+				continue
+			}
+		case <-ticker.C:
+		}
+		q.flush(pending)
+		pending = nil
+		if q.flushed != nil {
+			q.flushed <- struct{}{}
+		}
+	}
+}
+
+// flush writes whatever was spooled, oldest first, and then the pending points.
+// Once a write fails, everything after it is spooled instead.
+func (q *MetricsQueue) flush(pending []metricPoint) {
+	if q.spool != nil {
+		for _, name := range q.spool.Batches() {
+			points, err := q.spool.Load(name)
+			if err != nil {
+				log.Println("Dropping unreadable spooled metrics:", err)
+				q.spool.Remove(name)
+				q.drop(spooledPoints(name))
+				continue
+			}
+			if err := q.write(points); err != nil {
+				q.save(pending)
+				return
+			}
+			q.spool.Remove(name)
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+	if err := q.write(pending); err != nil {
+		q.save(pending)
+	}
+}
+
+// write writes the points, retrying if it fails, until the queue is closed.
+func (q *MetricsQueue) write(points []metricPoint) (err error) {
+	backoff := q.backoff
+	for attempt := 0; ; attempt++ {
+		if err = q.writer.WritePoints(points); err == nil || attempt >= q.retries || !q.sleep(backoff) {
+			break
+		}
+		backoff *= 2
+	}
+	if err != nil {
+		if !q.failing {
+			log.Println("Failed to write metrics, holding on to them:", err)
+			q.failing = true
+		}
+		return
+	}
+	if q.failing {
+		log.Printf("Writing metrics again, %d points still queued.\n", q.Queued()-int64(len(points)))
+		q.failing = false
+	}
+	atomic.AddInt64(&q.queued, -int64(len(points)))
+	return
+}
+
+// sleep waits between retries, returning false if the queue is closed first.
+func (q *MetricsQueue) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-q.closing:
+		return false
+	}
+}
+
+// save spools the points, or drops them if there's no spooling them.
+func (q *MetricsQueue) save(points []metricPoint) {
+	if len(points) == 0 {
+		return
+	}
+	if q.spool == nil {
+		q.drop(len(points))
+		return
+	}
+	dropped, err := q.spool.Save(points)
+	if err != nil {
+		log.Println("Failed to spool metrics:", err)
+		q.drop(len(points))
+	}
+	q.drop(dropped)
+}
+
+func (q *MetricsQueue) drop(n int) {
+	atomic.AddInt64(&q.queued, -int64(n))
+	atomic.AddUint64(&q.dropped, uint64(n))
+}
+
+// metricsSpool keeps batches of points on disk, one file per batch, named for
+// when it was saved and how many points it holds. It holds at most max
+// batches, dropping the oldest to make room.
+type metricsSpool struct {
+	dir string
+	max int
+}
+
+// openMetricsSpool creates the spool directory, if need be.
+func openMetricsSpool(dir string, max int) (*metricsSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &metricsSpool{dir: dir, max: max}, nil
+}
+
+// Batches returns the names of the spooled batches, oldest first.
+func (s *metricsSpool) Batches() []string {
+	names, _ := filepath.Glob(filepath.Join(s.dir, "*.gob"))
+	for i, name := range names {
+		names[i] = filepath.Base(name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Points returns the number of points spooled.
+func (s *metricsSpool) Points() (n int) {
+	for _, name := range s.Batches() {
+		n += spooledPoints(name)
+	}
+	return
+}
+
+// spooledPoints returns the number of points in a batch, from its name.
+func spooledPoints(name string) int {
+	name = strings.TrimSuffix(name, ".gob")
+	n, _ := strconv.Atoi(name[strings.LastIndex(name, "-")+1:])
+	return n
+}
+
+// Save spools a batch, returning how many points were dropped to make room.
+func (s *metricsSpool) Save(points []metricPoint) (dropped int, err error) {
+	tmp, err := ioutil.TempFile(s.dir, ".batch")
+	if err != nil {
+		return
+	}
+	if err := gob.NewEncoder(tmp).Encode(points); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	name := fmt.Sprintf("%020d-%d.gob", time.Now().UnixNano(), len(points))
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	batches := s.Batches()
+	for len(batches) > s.max {
+		dropped += spooledPoints(batches[0])
+		s.Remove(batches[0])
+		batches = batches[1:]
+	}
+	return dropped, nil
+}
+
+// Load reads a spooled batch.
+func (s *metricsSpool) Load(name string) (points []metricPoint, err error) {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	err = gob.NewDecoder(f).Decode(&points)
+	return
+}
+
+// Remove deletes a spooled batch.
+func (s *metricsSpool) Remove(name string) {
+	os.Remove(filepath.Join(s.dir, name))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePointWriter keeps the points it's given, or fails while it's down.
+type fakePointWriter struct {
+	mu     sync.Mutex
+	down   bool
+	points []metricPoint
+}
+
+func (w *fakePointWriter) WritePoints(points []metricPoint) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.down {
+		return errors.New("connection refused")
+	}
+	w.points = append(w.points, points...)
+	return nil
+}
+
+func (w *fakePointWriter) setDown(down bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.down = down
+}
+
+func (w *fakePointWriter) written() []metricPoint {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]metricPoint(nil), w.points...)
+}
+
+func testPoint(i int) metricPoint {
+	return metricPoint{"tracker", metricTags{"target": "Spotify"}, metricFields{"tick": i, "cpu": 1.5, "closing": false}, time.Unix(int64(i), 0)}
+}
+
+// newTestMetricsQueue returns a queue that only flushes when full, and doesn't
+// wait between retries.
+func newTestMetricsQueue(w pointWriter, spool *metricsSpool, batch int) *MetricsQueue {
+	q := NewMetricsQueue(w, spool, batch, time.Hour)
+	q.backoff = time.Millisecond
+	q.flushed = make(chan struct{})
+	return q
+}
+
+func TestMetricsQueueBatches(t *testing.T) {
+	w := &fakePointWriter{}
+	q := newTestMetricsQueue(w, nil, 3)
+	q.Add(testPoint(1), testPoint(2))
+	q.Add(testPoint(3))
+	<-q.flushed
+	want := []metricPoint{testPoint(1), testPoint(2), testPoint(3)}
+	if got := w.written(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if q.Queued() != 0 || q.Dropped() != 0 {
+		t.Errorf("got %d queued, %d dropped, want none", q.Queued(), q.Dropped())
+	}
+}
+
+func TestMetricsQueueSpoolsAndReplays(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spool, err := openMetricsSpool(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &fakePointWriter{down: true}
+	q := newTestMetricsQueue(w, spool, 1)
+
+	// Down, each batch is spooled, and the oldest dropped once there's too many.
+	for i := 1; i <= 3; i++ {
+		q.Add(testPoint(i))
+		<-q.flushed
+	}
+	if len(w.written()) != 0 || len(spool.Batches()) != 2 {
+		t.Fatalf("got %d written, %d spooled, want 0 and 2", len(w.written()), len(spool.Batches()))
+	}
+	if q.Queued() != 2 || q.Dropped() != 1 {
+		t.Errorf("got %d queued, %d dropped, want 2 and 1", q.Queued(), q.Dropped())
+	}
+
+	// Back up, what was spooled is written first, in order.
+	w.setDown(false)
+	q.Add(testPoint(4))
+	<-q.flushed
+	want := []metricPoint{testPoint(2), testPoint(3), testPoint(4)}
+	if got := w.written(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(spool.Batches()) != 0 || q.Queued() != 0 {
+		t.Errorf("got %d spooled, %d queued, want none", len(spool.Batches()), q.Queued())
+	}
+}
+
+func TestMetricsQueueResumesSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spool, err := openMetricsSpool(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spool.Save([]metricPoint{testPoint(1), testPoint(2)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Left over from last time, it's counted and written with the next batch.
+	w := &fakePointWriter{}
+	q := newTestMetricsQueue(w, spool, 1)
+	if q.Queued() != 2 {
+		t.Errorf("got %d queued, want 2", q.Queued())
+	}
+	q.Add(testPoint(3))
+	<-q.flushed
+	want := []metricPoint{testPoint(1), testPoint(2), testPoint(3)}
+	if got := w.written(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMetricsQueueClosesWhileDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spool, err := openMetricsSpool(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &fakePointWriter{down: true}
+	q := NewMetricsQueue(w, spool, 10, time.Hour)
+
+	// Points keep coming in while it closes, and after.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			q.WritePoints([]metricPoint{testPoint(i)})
+		}
+	}()
+	// It doesn't wait out the retries, but spools what it couldn't write.
+	start := time.Now()
+	q.Close()
+	if took := time.Since(start); took > q.backoff {
+		t.Errorf("took %s to close, want no retries", took)
+	}
+	wg.Wait()
+	if q.Queued() != int64(spool.Points()) {
+		t.Errorf("got %d queued, %d spooled, want them all spooled", q.Queued(), spool.Points())
+	}
+}
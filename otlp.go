@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// OTLP protocols, per --otlp-protocol.
+const (
+	otlpHTTP = "http/protobuf"
+	otlpGRPC = "grpc"
+)
+
+// otlpServices are the gRPC services that export each signal.
+var otlpServices = map[string]string{
+	"metrics": "opentelemetry.proto.collector.metrics.v1.MetricsService",
+	"logs":    "opentelemetry.proto.collector.logs.v1.LogsService",
+}
+
+// OTLP severity numbers, for log records.
+const (
+	otlpInfo = 9
+	otlpWarn = 13
+)
+
+// otlpInterventions are the events logged as warnings, being what the tracker
+// did to the target, rather than what it noticed.
+var otlpInterventions = map[EventType]bool{
+	EventClosing:   true,
+	EventKilled:    true,
+	EventThrottled: true,
+	EventFrozen:    true,
+	EventGivingUp:  true,
+}
+
+// OTLP exports metrics and tracker events to an OpenTelemetry collector, using
+// OTLP/HTTP or gRPC with protobuf encoding. Each numeric field of a point
+// becomes a gauge, e.g. "spotifywatcher.process.cpu", with the point's tags as
+// attributes, and each event becomes a log record. Everything shares the
+// resource's attributes, such as the host and version. Events are exported in
+// the background. Implements pointWriter and EventHandler.
+type OTLP struct {
+	*EventQueue
+	endpoint string
+	grpc     bool
+	header   http.Header
+	client   *http.Client
+	resource []byte // Encoded Resource message.
+
+	failures uint64
+}
+
+// NewOTLP starts exporting events to the collector at endpoint, e.g.
+// http://localhost:4318 for OTLP/HTTP, or http://localhost:4317 for gRPC, which
+// is spoken over TLS for https:// and in the clear for http://. Headers are
+// given as "Name: value".
+func NewOTLP(endpoint, protocol string, headers []string, resource map[string]string, timeout time.Duration) (*OTLP, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q, expected http:// or https://", endpoint)
+	}
+	o := &OTLP{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		header:   make(http.Header),
+		client:   &http.Client{Timeout: timeout},
+	}
+	switch protocol {
+	case otlpHTTP:
+		o.header.Set("Content-Type", "application/x-protobuf")
+	case otlpGRPC:
+		// gRPC needs HTTP/2, which without TLS is spoken from the start.
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Protocols = new(http.Protocols)
+		if u.Scheme == "http" {
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		} else {
+			transport.Protocols.SetHTTP2(true)
+		}
+		o.client.Transport = transport
+		o.grpc = true
+		o.header.Set("Content-Type", "application/grpc")
+		o.header.Set("TE", "trailers")
+	default:
+		return nil, fmt.Errorf("invalid OTLP protocol %q, expected %s or %s", protocol, otlpHTTP, otlpGRPC)
+	}
+	if err := parseHeaders(o.header, headers); err != nil {
+		return nil, err
+	}
+	var r protoMessage
+	for _, k := range sortedKeys(resource) {
+		r.Bytes(1, otlpAttribute(k, resource[k]))
+	}
+	o.resource = r
+	o.EventQueue = NewEventQueue("OTLP export", o.exportEvent)
+	return o, nil
+}
+
+// WritePoints exports the points as gauges.
+func (o *OTLP) WritePoints(points []metricPoint) error {
+	dataPoints := make(map[string][]protoMessage)
+	for _, p := range points {
+		var attributes protoMessage
+		for _, k := range sortedKeys(p.Tags) {
+			if k != "host" && k != "target" { // Part of the resource.
+				attributes.Bytes(7, otlpAttribute(k, p.Tags[k]))
+			}
+		}
+		for field, value := range p.Fields {
+			v, ok := otlpValue(value)
+			if !ok {
+				continue
+			}
+			var dp protoMessage
+			dp = append(dp, attributes...)
+			dp.Fixed64(3, uint64(p.Time.UnixNano()))
+			dp.Double(4, v)
+			name := "spotifywatcher." + p.Name + "." + field
+			dataPoints[name] = append(dataPoints[name], dp)
+		}
+	}
+	names := make([]string, 0, len(dataPoints))
+	for name := range dataPoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var scope protoMessage
+	scope.Bytes(1, otlpScope())
+	for _, name := range names {
+		var gauge, metric protoMessage
+		for _, dp := range dataPoints[name] {
+			gauge.Bytes(1, dp)
+		}
+		metric.String(1, name)
+		metric.Bytes(5, gauge)
+		scope.Bytes(2, metric)
+	}
+	var resourceMetrics, req protoMessage
+	resourceMetrics.Bytes(1, o.resource)
+	resourceMetrics.Bytes(2, scope)
+	req.Bytes(1, resourceMetrics)
+	return o.export("metrics", req)
+}
+
+// Failures returns the number of events which couldn't be exported.
+func (o *OTLP) Failures() uint64 {
+	return atomic.LoadUint64(&o.failures) + o.Dropped()
+}
+
+func (o *OTLP) exportEvent(e Event) {
+	if err := o.export("logs", o.logs(e)); err != nil {
+		log.Printf("Failed to export %q event over OTLP: %s\n", e.Type, err)
+		atomic.AddUint64(&o.failures, 1)
+	}
+}
+
+// logs returns the request to export the event, as a log record with the event
+// as its JSON body.
+func (o *OTLP) logs(e Event) protoMessage {
+	var record protoMessage
+	record.Fixed64(1, uint64(e.Time.UnixNano()))
+	record.Fixed64(11, uint64(time.Now().UnixNano()))
+	if otlpInterventions[e.Type] {
+		record.Varint(2, otlpWarn)
+		record.String(3, "WARN")
+	} else {
+		record.Varint(2, otlpInfo)
+		record.String(3, "INFO")
+	}
+	var body protoMessage
+	body.String(1, string(e.JSON()))
+	record.Bytes(5, body)
+	record.Bytes(6, otlpAttribute("event.name", string(e.Type)))
+	record.Bytes(6, otlpAttribute("pid", e.Pid))
+	record.Bytes(6, otlpAttribute("player_state", string(e.State)))
+
+	var scope, resourceLogs, req protoMessage
+	scope.Bytes(1, otlpScope())
+	scope.Bytes(2, record)
+	resourceLogs.Bytes(1, o.resource)
+	resourceLogs.Bytes(2, scope)
+	req.Bytes(1, resourceLogs)
+	return req
+}
+
+// export sends the request to export a signal, "metrics" or "logs". Over gRPC,
+// it's the message of a unary call to the signal's service.
+func (o *OTLP) export(signal string, msg []byte) error {
+	path, body := "/v1/"+signal, msg
+	if o.grpc {
+		path = "/" + otlpServices[signal] + "/Export"
+		body = make([]byte, 5, 5+len(msg)) // Uncompressed, then the length.
+		binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+		body = append(body, msg...)
+	}
+	req, err := http.NewRequest("POST", o.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range o.header {
+		req.Header[k] = v
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body) // Read to the end, for any trailers.
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	if o.grpc {
+		return grpcStatus(resp)
+	}
+	return nil
+}
+
+// grpcStatus returns the error of a gRPC call, if it failed. The status is in
+// the trailers, or in the headers if the call failed without a response.
+func grpcStatus(resp *http.Response) error {
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	switch status {
+	case "0":
+		return nil
+	case "":
+		return fmt.Errorf("no gRPC status in response")
+	}
+	if m, err := url.PathUnescape(message); err == nil {
+		message = m
+	}
+	return fmt.Errorf("gRPC status %s: %s", status, message)
+}
+
+// otlpAttribute encodes a KeyValue, with a string value.
+func otlpAttribute(key, value string) []byte {
+	var v, kv protoMessage
+	v.String(1, value)
+	kv.String(1, key)
+	kv.Bytes(2, v)
+	return kv
+}
+
+// otlpScope encodes the InstrumentationScope, which is us.
+func otlpScope() []byte {
+	var scope protoMessage
+	scope.String(1, "spotifywatcher")
+	scope.String(2, version)
+	return scope
+}
+
+// otlpValue returns a field's value as a double, if it's a number or bool.
+func otlpValue(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// protoFields decodes a message's fields, for the fake collector. Varints and
+// fixed64s are kept as 8 little-endian bytes.
+func protoFields(t *testing.T, b []byte) map[int][][]byte {
+	fields := make(map[int][][]byte)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		b = b[n:]
+		var value []byte
+		switch tag & 7 {
+		case protoVarint:
+			v, n := binary.Uvarint(b)
+			value = make([]byte, 8)
+			binary.LittleEndian.PutUint64(value, v)
+			b = b[n:]
+		case protoFixed64:
+			value, b = b[:8], b[8:]
+		case protoBytes:
+			size, n := binary.Uvarint(b)
+			value, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+		fields[int(tag>>3)] = append(fields[int(tag>>3)], value)
+	}
+	return fields
+}
+
+// protoPath follows embedded messages down the fields given, returning all the
+// values at the end of the path.
+func protoPath(t *testing.T, b []byte, path ...int) (values [][]byte) {
+	values = [][]byte{b}
+	for _, field := range path {
+		var next [][]byte
+		for _, v := range values {
+			next = append(next, protoFields(t, v)[field]...)
+		}
+		values = next
+	}
+	return
+}
+
+// otlpAttributes decodes KeyValues with string values.
+func otlpAttributes(t *testing.T, kvs [][]byte) map[string]string {
+	attributes := make(map[string]string)
+	for _, kv := range kvs {
+		fields := protoFields(t, kv)
+		attributes[string(fields[1][0])] = string(protoFields(t, fields[2][0])[1][0])
+	}
+	return attributes
+}
+
+// fakeCollector receives OTLP/HTTP requests, by path.
+func fakeCollector(t *testing.T) (*httptest.Server, chan map[string][]byte) {
+	received := make(chan map[string][]byte, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("X-Scope") != "home" {
+			t.Errorf("got headers %v", r.Header)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- map[string][]byte{r.URL.Path: body}
+	}))
+	return server, received
+}
+
+var otlpTestResource = map[string]string{"host.name": "mac", "service.version": version}
+
+func TestOTLPMetrics(t *testing.T) {
+	server, received := fakeCollector(t)
+	defer server.Close()
+	o, err := NewOTLP(server.URL, otlpHTTP, []string{"X-Scope: home"}, otlpTestResource, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = o.WritePoints([]metricPoint{
+		{"process", metricTags{"target": "Spotify", "command": "Spotify", "pid": "42"}, metricFields{
+			"cpu": 12.5, "threads": 30, "state": "S",
+		}, time.Unix(3, 0)},
+		{"tracker", metricTags{"target": "Spotify", "player_state": "paused"}, metricFields{"frozen": true}, time.Unix(3, 0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := (<-received)["/v1/metrics"]
+	resource := otlpAttributes(t, protoPath(t, req, 1, 1, 1))
+	if !reflect.DeepEqual(resource, otlpTestResource) {
+		t.Errorf("got resource %v, want %v", resource, otlpTestResource)
+	}
+	if scope := protoPath(t, req, 1, 2, 1, 1); string(scope[0]) != "spotifywatcher" {
+		t.Errorf("got scope %q", scope)
+	}
+	metrics := make(map[string][]byte)
+	for _, m := range protoPath(t, req, 1, 2, 2) {
+		metrics[string(protoPath(t, m, 1)[0])] = m
+	}
+	var names []string
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := []string{"spotifywatcher.process.cpu", "spotifywatcher.process.threads", "spotifywatcher.tracker.frozen"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("got metrics %v, want %v", names, want)
+	}
+	dp := protoPath(t, metrics["spotifywatcher.process.cpu"], 5, 1)[0]
+	if v := math.Float64frombits(binary.LittleEndian.Uint64(protoPath(t, dp, 4)[0])); v != 12.5 {
+		t.Errorf("got cpu %v, want 12.5", v)
+	}
+	if ts := binary.LittleEndian.Uint64(protoPath(t, dp, 3)[0]); ts != uint64(3*time.Second) {
+		t.Errorf("got time %d", ts)
+	}
+	// The host and target are the resource's.
+	attributes := otlpAttributes(t, protoPath(t, dp, 7))
+	if !reflect.DeepEqual(attributes, map[string]string{"command": "Spotify", "pid": "42"}) {
+		t.Errorf("got attributes %v", attributes)
+	}
+}
+
+func TestOTLPEvents(t *testing.T) {
+	server, received := fakeCollector(t)
+	defer server.Close()
+	o, err := NewOTLP(server.URL+"/", otlpHTTP, []string{"X-Scope: home"}, otlpTestResource, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.HandleEvent(Event{Type: EventKilled, Time: time.Unix(5, 0), Target: "Spotify", Pid: "42", State: StateClosing})
+	var req []byte
+	select {
+	case r := <-received:
+		req = r["/v1/logs"]
+	case <-time.After(2 * time.Second):
+		t.Fatal("no logs exported")
+	}
+	record := protoPath(t, req, 1, 2, 2)[0]
+	if severity := protoPath(t, record, 3); string(severity[0]) != "WARN" {
+		t.Errorf("got severity %q, want WARN", severity)
+	}
+	if body := string(protoPath(t, record, 5, 1)[0]); !strings.Contains(body, `"event":"killed"`) {
+		t.Errorf("got body %s", body)
+	}
+	attributes := otlpAttributes(t, protoPath(t, record, 6))
+	if attributes["event.name"] != "killed" || attributes["pid"] != "42" {
+		t.Errorf("got attributes %v", attributes)
+	}
+	if o.Failures() != 0 {
+		t.Errorf("got %d failures", o.Failures())
+	}
+}
+
+func TestOTLPEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"grpc://localhost:4317", "localhost:4317", "ftp://localhost"} {
+		if _, err := NewOTLP(endpoint, otlpGRPC, nil, nil, time.Second); err == nil {
+			t.Errorf("%s: got no error", endpoint)
+		}
+	}
+	if _, err := NewOTLP("http://localhost:4317", "grpc/json", nil, nil, time.Second); err == nil {
+		t.Error("grpc/json: got no error")
+	}
+}
+
+// fakeGRPCCollector receives gRPC calls over HTTP/2 without TLS, by path,
+// answering with the given status.
+func fakeGRPCCollector(t *testing.T, status string) (*httptest.Server, chan map[string][]byte) {
+	received := make(chan map[string][]byte, 8)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" || r.Header.Get("Te") != "trailers" {
+			t.Errorf("got %s, headers %v", r.Proto, r.Header)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:])) != len(body)-5 {
+			t.Errorf("got badly framed message %q", body)
+		} else {
+			received <- map[string][]byte{r.URL.Path: body[5:]}
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write([]byte{0, 0, 0, 0, 0}) // An empty response.
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", status)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "bad%20data")
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	return server, received
+}
+
+func TestOTLPOverGRPC(t *testing.T) {
+	server, received := fakeGRPCCollector(t, "0")
+	defer server.Close()
+	o, err := NewOTLP(server.URL, otlpGRPC, nil, otlpTestResource, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = o.WritePoints([]metricPoint{
+		{"tracker", metricTags{"target": "Spotify"}, metricFields{"frozen": true}, time.Unix(3, 0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := (<-received)["/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"]
+	if name := protoPath(t, req, 1, 2, 2, 1); len(name) != 1 || string(name[0]) != "spotifywatcher.tracker.frozen" {
+		t.Errorf("got metrics %q", name)
+	}
+
+	o.HandleEvent(Event{Type: EventFrozen, Time: time.Unix(5, 0), Target: "Spotify"})
+	o.Close()
+	req = (<-received)["/opentelemetry.proto.collector.logs.v1.LogsService/Export"]
+	if severity := protoPath(t, req, 1, 2, 2, 3); len(severity) != 1 || string(severity[0]) != "WARN" {
+		t.Errorf("got severity %q, want WARN", severity)
+	}
+	if o.Failures() != 0 {
+		t.Errorf("got %d failures", o.Failures())
+	}
+}
+
+func TestOTLPOverGRPCFails(t *testing.T) {
+	server, _ := fakeGRPCCollector(t, "3")
+	defer server.Close()
+	o, err := NewOTLP(server.URL, otlpGRPC, nil, otlpTestResource, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	err = o.WritePoints([]metricPoint{{"tracker", nil, metricFields{"cpu": 1.0}, time.Unix(3, 0)}})
+	if err == nil || err.Error() != "gRPC status 3: bad data" {
+		t.Errorf("got %v, want gRPC status 3", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Player controls a music player app, such as Spotify. Players may hang, so
+// each call takes a context to cancel it by.
+type Player interface {
+	// State returns what the player is doing, or whether it's in the foreground.
+	State(ctx context.Context) (State, error)
+	Quit(ctx context.Context) error
+	Pause(ctx context.Context) error
+	Play(ctx context.Context) error
+	// NowPlaying returns the current track, if any.
+	NowPlaying(ctx context.Context) (Track, error)
+}
+
+// ActiveWindow finds the process that owns the window the user is focused on.
+type ActiveWindow interface {
+	Pid(ctx context.Context) (int, error)
+}
+
+// Track describes a track (or episode) loaded in the player.
+type Track struct {
+	Name   string `json:"name"`
+	Artist string `json:"artist"`
+	Album  string `json:"album"`
+	URI    string `json:"uri"`
+}
+
+// Kind returns what sort of thing the track is, from its URI, such as "track",
+// "episode" (podcasts) or "local" (local files). Either form of URI will do:
+// "spotify:episode:512ojhOuo1ktJprKbVcKyQ" or
+// "https://open.spotify.com/episode/512ojhOuo1ktJprKbVcKyQ".
+func (t Track) Kind() string {
+	uri := t.URI
+	if i := strings.Index(uri, "open.spotify.com/"); i >= 0 {
+		uri = strings.Replace(uri[i+len("open.spotify.com/"):], "/", ":", -1)
+	} else {
+		uri = strings.TrimPrefix(uri, "spotify:")
+	}
+	if i := strings.Index(uri, ":"); i > 0 {
+		return uri[:i]
+	}
+	return ""
+}
+
+func (t Track) String() string {
+	if t == (Track{}) {
+		return "(nothing)"
+	}
+	return fmt.Sprintf("%q by %s", t.Name, t.Artist)
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+var trackKindTestTable = []struct {
+	uri  string
+	kind string
+}{
+	{"spotify:track:5qMZ8wBOPvOUVVmr2JGbmG", "track"},
+	{"spotify:episode:512ojhOuo1ktJprKbVcKyQ", "episode"},
+	{"spotify:local:Aphex+Twin:Windowlicker:Windowlicker:365", "local"},
+	{"https://open.spotify.com/track/5qMZ8wBOPvOUVVmr2JGbmG", "track"},
+	{"https://open.spotify.com/episode/512ojhOuo1ktJprKbVcKyQ", "episode"},
+	{"", ""},
+	{"garbage", ""},
+}
+
+func TestTrackKind(t *testing.T) {
+	for _, tt := range trackKindTestTable {
+		if kind := (Track{URI: tt.uri}).Kind(); kind != tt.kind {
+			t.Errorf("Kind(%q): got %q, want %q", tt.uri, kind, tt.kind)
+		}
+	}
+}
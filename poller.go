@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// StatePoller polls the player's state (and what it's playing, and whether the
+// user is idle) in the background, so that a slow or hung player never holds up
+// the tick loop, which reads the latest known state instead. Each poll is given
+// a timeout, and failed polls are retried a few times, backing off in between.
+type StatePoller struct {
+	player  Player
+	idle    IdleMonitor // Optional.
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+
+	mu      sync.Mutex
+	state   State
+	track   Track
+	updated time.Time // Of the last successful poll.
+	err     error     // Of the last poll, if it failed.
+	errors  uint64
+
+	userIdle time.Duration
+	locked   bool
+
+	paused bool // While the player can't answer, such as when it's frozen.
+}
+
+// NewStatePoller returns a poller for the player. Nothing is polled until Poll
+// or Start is called.
+func NewStatePoller(player Player, timeout time.Duration) *StatePoller {
+	return &StatePoller{player: player, timeout: timeout, retries: stateRetries, backoff: 250 * time.Millisecond}
+}
+
+// stateRetries is how many more times we ask the player its state, if it fails
+// to tell us the first time.
+const stateRetries = 2
+
+// Start polls every interval, in the background.
+func (p *StatePoller) Start(interval time.Duration) {
+	go func() {
+		p.Poll()
+		for range time.Tick(interval) {
+			p.Poll()
+		}
+	}()
+}
+
+// Poll reads the player's state, waiting for it at most the timeout each time
+// it's asked, and retrying if that fails. Nothing is polled while paused.
+func (p *StatePoller) Poll() {
+	p.mu.Lock()
+	paused := p.paused
+	p.mu.Unlock()
+	if paused {
+		return
+	}
+	state, track, err := p.pollPlayer()
+	backoff := p.backoff
+	for i := 0; err != nil && i < p.retries; i++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		state, track, err = p.pollPlayer()
+	}
+	var userIdle time.Duration
+	var locked bool
+	if p.idle != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+		defer cancel()
+		// If we can't tell, the user is taken to be active.
+		if i, l, err := p.idle.Idle(ctx); err == nil {
+			userIdle, locked = i, l
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.userIdle, p.locked = userIdle, locked
+	if err != nil {
+		if p.err == nil {
+			log.Println("Failed to get Spotify state:", err)
+		}
+		p.err = err
+		p.errors += 1
+		return
+	}
+	if p.err != nil {
+		log.Printf("Got Spotify state again, after %d errors.\n", p.errors)
+	}
+	p.state, p.track, p.updated, p.err = state, track, time.Now(), nil
+}
+
+func (p *StatePoller) pollPlayer() (state State, track Track, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	state, err = p.player.State(ctx)
+	if err == nil && state != StateClosed {
+		// Knowing the track is nice, but the state is what matters.
+		track, _ = p.player.NowPlaying(ctx)
+	}
+	return
+}
+
+// State returns the latest known state, and how long ago it was polled. If the
+// last poll failed, its error is returned too. If the state was never polled
+// successfully, it's unknown.
+func (p *StatePoller) State() (s State, age time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.updated.IsZero() {
+		return StateUnknown, 0, p.err
+	}
+	return p.state, time.Since(p.updated), p.err
+}
+
+// Track returns the latest known track loaded in the player.
+func (p *StatePoller) Track() Track {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.track
+}
+
+// Pause stops polling the player, which can't answer, until resumed. The last
+// known state is kept.
+func (p *StatePoller) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = true
+}
+
+// Resume carries on polling the player, from the next poll.
+func (p *StatePoller) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = false
+}
+
+// Idle returns how long the user had been idle for, and whether the screen was
+// locked, as of the last poll.
+func (p *StatePoller) Idle() (idle time.Duration, locked bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.userIdle, p.locked
+}
+
+// Errors returns the number of polls that have failed.
+func (p *StatePoller) Errors() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.errors
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// hungPlayer answers with its state until hung, then never answers at all.
+type hungPlayer struct {
+	fakePlayer
+	hung bool
+}
+
+func (h *hungPlayer) State(ctx context.Context) (State, error) {
+	if h.hung {
+		<-ctx.Done()
+		return StateUnknown, ctx.Err()
+	}
+	return h.fakePlayer.State(ctx)
+}
+
+func TestStatePollerTimesOut(t *testing.T) {
+	player := &hungPlayer{fakePlayer: fakePlayer{states: []State{StatePaused}}}
+	p := NewStatePoller(player, 50*time.Millisecond)
+	p.backoff = time.Millisecond
+
+	if s, _, err := p.State(); s != StateUnknown || err != nil {
+		t.Errorf("before polling: got %s (%v), want unknown", s, err)
+	}
+	p.Poll()
+	if s, _, err := p.State(); s != StatePaused || err != nil {
+		t.Errorf("got %s (%v), want %s", s, err, StatePaused)
+	}
+
+	player.hung = true
+	start := time.Now()
+	p.Poll()
+	p.Poll()
+	if time.Since(start) > time.Second {
+		t.Errorf("polling a hung player took %s", time.Since(start))
+	}
+	// The last known state is kept, along with how old it is and why.
+	s, age, err := p.State()
+	if s != StatePaused || err == nil || age < 100*time.Millisecond {
+		t.Errorf("got %s, %s old (%v), want stale %s with error", s, age, err, StatePaused)
+	}
+	if p.Errors() != 2 {
+		t.Errorf("got %d errors, want 2", p.Errors())
+	}
+
+	player.hung = false
+	p.Poll()
+	if s, age, err := p.State(); s != StatePaused || err != nil || age > 100*time.Millisecond {
+		t.Errorf("after recovering: got %s, %s old (%v)", s, age, err)
+	}
+}
+
+func TestStatePollerPauses(t *testing.T) {
+	player := &hungPlayer{fakePlayer: fakePlayer{states: []State{StatePaused}}}
+	p := NewStatePoller(player, 50*time.Millisecond)
+	p.backoff = time.Millisecond
+	p.Poll()
+
+	// Frozen, the player would never answer, so it isn't asked.
+	player.hung = true
+	p.Pause()
+	start := time.Now()
+	p.Poll()
+	if time.Since(start) > 10*time.Millisecond || p.Errors() != 0 {
+		t.Errorf("polled a paused player: took %s, %d errors", time.Since(start), p.Errors())
+	}
+	if s, _, err := p.State(); s != StatePaused || err != nil {
+		t.Errorf("while paused: got %s (%v), want %s", s, err, StatePaused)
+	}
+
+	player.hung = false
+	player.states = []State{StatePlaying}
+	p.Resume()
+	p.Poll()
+	if s, _, err := p.State(); s != StatePlaying || err != nil {
+		t.Errorf("after resuming: got %s (%v), want %s", s, err, StatePlaying)
+	}
+}
+
+func TestTrackerTreatsStaleStateAsUnknown(t *testing.T) {
+	defer withOptions(trackerTestOptions)()
+	player := &hungPlayer{fakePlayer: fakePlayer{states: []State{StateForeground}}}
+	tr := newTracker(player)
+
+	tr.poller.Poll()
+	if s := tr.spotifyState(); s != StateForeground {
+		t.Errorf("got %s, want %s", s, StateForeground)
+	}
+	opts.TopInterval = 0 // Anything is stale now.
+	time.Sleep(time.Millisecond)
+	if s := tr.spotifyState(); s != StateUnknown {
+		t.Errorf("got %s, want stale state to be %s", s, StateUnknown)
+	}
+}
+
+// flakyPlayer fails to answer the first few times it's asked its state.
+type flakyPlayer struct {
+	fakePlayer
+	failures int
+}
+
+func (f *flakyPlayer) State(ctx context.Context) (State, error) {
+	if f.failures > 0 {
+		f.failures -= 1
+		return StateUnknown, errors.New("AppleEvent timed out")
+	}
+	return f.fakePlayer.State(ctx)
+}
+
+func TestStatePollerRetries(t *testing.T) {
+	player := &flakyPlayer{fakePlayer: fakePlayer{states: []State{StatePlaying}}, failures: 2}
+	p := NewStatePoller(player, 50*time.Millisecond)
+	p.backoff = time.Millisecond
+
+	p.Poll()
+	if s, _, err := p.State(); s != StatePlaying || err != nil || p.Errors() != 0 {
+		t.Errorf("got %s (%v), %d errors, want %s after retrying", s, err, p.Errors(), StatePlaying)
+	}
+	player.failures = 3
+	p.Poll()
+	if _, _, err := p.State(); err == nil || p.Errors() != 1 {
+		t.Errorf("got %v, %d errors, want the poll to fail once retries ran out", err, p.Errors())
+	}
+}
+
+var unknownStateTestTable = []struct {
+	policy string
+	events []EventType
+}{
+	{unknownAsBackground, []EventType{EventClosing}},
+	{unknownAsForeground, nil},
+	{unknownSkipped, nil},
+}
+
+func TestTrackerUnknownStatePolicy(t *testing.T) {
+	for _, tt := range unknownStateTestTable {
+		o := trackerTestOptions
+		o.UnknownState = tt.policy
+		o.AllowedBreaches = 0
+		restore := withOptions(o)
+		player := &flakyPlayer{fakePlayer: fakePlayer{states: []State{StatePlaying}}, failures: 1 << 30}
+		tr := newTracker(player)
+		tr.poller.retries = 0
+		events := &eventRecorder{}
+		tr.handlers = append(tr.handlers, events)
+
+		p := Process{Pid: "1", Command: "Spotify"}
+		observeCpu(t, tr, p, 1)
+		if tr.warnedUnknown {
+			t.Errorf("%s: warned about the unknown state too soon", tt.policy)
+		}
+		// Unknown for long enough, we warn about it.
+		tr.stateSince = tr.stateSince.Add(-2 * unknownStateWarning)
+		observeCpu(t, tr, p, 1)
+		if !tr.warnedUnknown {
+			t.Errorf("%s: expected a warning about the unknown state", tt.policy)
+		}
+		observeCpu(t, tr, p, 20, 20)
+		if !reflect.DeepEqual(events.types(), tt.events) {
+			t.Errorf("%s: got events %v, want %v", tt.policy, events.types(), tt.events)
+		}
+		restore()
+	}
+}
@@ -0,0 +1,32 @@
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// powerSource returns "ac" or "battery", depending on whether mains power is
+// online, or "" if there's no telling.
+func powerSource() string {
+	return powerSourceIn("/sys/class/power_supply")
+}
+
+func powerSourceIn(dir string) string {
+	supplies, _ := filepath.Glob(filepath.Join(dir, "*"))
+	source := ""
+	for _, supply := range supplies {
+		typ, err := ioutil.ReadFile(filepath.Join(supply, "type"))
+		if err != nil || strings.TrimSpace(string(typ)) != "Mains" {
+			continue
+		}
+		online, _ := ioutil.ReadFile(filepath.Join(supply, "online"))
+		if strings.TrimSpace(string(online)) == "1" {
+			return "ac"
+		}
+		source = "battery"
+	}
+	return source
+}
@@ -0,0 +1,43 @@
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writePowerSupply(t *testing.T, dir, name, typ, online string) {
+	supply := filepath.Join(dir, name)
+	if err := os.MkdirAll(supply, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for file, value := range map[string]string{"type": typ + "\n", "online": online + "\n"} {
+		if err := ioutil.WriteFile(filepath.Join(supply, file), []byte(value), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPowerSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "power_supply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if got := powerSourceIn(dir); got != "" {
+		t.Errorf("no supplies: got %q, want unknown", got)
+	}
+	writePowerSupply(t, dir, "BAT0", "Battery", "")
+	writePowerSupply(t, dir, "AC", "Mains", "0")
+	if got := powerSourceIn(dir); got != "battery" {
+		t.Errorf("unplugged: got %q, want battery", got)
+	}
+	writePowerSupply(t, dir, "AC", "Mains", "1")
+	if got := powerSourceIn(dir); got != "ac" {
+		t.Errorf("plugged in: got %q, want ac", got)
+	}
+}
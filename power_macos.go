@@ -0,0 +1,30 @@
+// +build darwin
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// powerSource returns "ac" or "battery", from pmset, or "" if there's no
+// telling.
+func powerSource() string {
+	out, err := exec.Command("/usr/bin/pmset", "-g", "batt").Output()
+	if err != nil {
+		return ""
+	}
+	return parsePmset(string(out))
+}
+
+// parsePmset reads the power source from the first line of `pmset -g batt`,
+// e.g. "Now drawing from 'AC Power'".
+func parsePmset(out string) string {
+	switch {
+	case strings.Contains(out, "'AC Power'"):
+		return "ac"
+	case strings.Contains(out, "'Battery Power'"):
+		return "battery"
+	}
+	return ""
+}
@@ -0,0 +1,17 @@
+// +build darwin
+
+package main
+
+import "testing"
+
+func TestParsePmset(t *testing.T) {
+	for out, want := range map[string]string{
+		"Now drawing from 'AC Power'\n -InternalBattery-0 (id=1234)\t100%; charged;":          "ac",
+		"Now drawing from 'Battery Power'\n -InternalBattery-0 (id=1234)\t85%; discharging;": "battery",
+		"": "",
+	} {
+		if got := parsePmset(out); got != want {
+			t.Errorf("parsePmset(%q): got %q, want %q", out, got, want)
+		}
+	}
+}
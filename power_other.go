@@ -0,0 +1,7 @@
+// +build !darwin,!linux
+
+package main
+
+func powerSource() string {
+	return ""
+}
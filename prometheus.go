@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// prometheusStates are the player states reported by the tracker, each of which
+// gets a series of the state gauge.
+var prometheusStates = []string{
+	"unknown",
+	string(StateForeground),
+	string(StateStopped),
+	string(StatePlaying),
+	string(StatePaused),
+	string(StateClosing),
+	string(StateClosed),
+}
+
+// prometheusGauges are the tracker fields exposed as gauges, and what they're
+// called.
+var prometheusGauges = []struct {
+	field, name, help string
+}{
+	{"cpu", "cpu_percent", "CPU use of the target at the last tick."},
+	{"median", "cpu_median_percent", "Median CPU use over the sample window."},
+	{"samples", "samples", "Samples in the window."},
+	{"breaches", "breaches", "Medians over the threshold since Spotify last started or was released."},
+	{"allowed_breaches", "allowed_breaches", "Breaches allowed before acting."},
+	{"threshold", "threshold_percent", "CPU threshold."},
+	{"misbehaving", "misbehaving", "Whether the target is over the threshold."},
+	{"closing", "closing", "Whether the target has been told to quit."},
+	{"throttled", "throttled", "Whether the target's CPU is limited."},
+	{"frozen", "frozen", "Whether the target is frozen."},
+}
+
+// prometheusProcessGauges are the process fields exposed as gauges.
+var prometheusProcessGauges = []struct {
+	field, name, help string
+}{
+	{"cpu", "process_cpu_percent", "CPU use of each of the target's processes."},
+	{"threads", "process_threads", "Threads of each of the target's processes."},
+	{"pageins", "process_pageins", "Page-ins of each of the target's processes."},
+}
+
+// Prometheus exposes the latest tick's metrics for Prometheus to scrape, in its
+// text format. It's given the same points as InfluxDB, and counts events as
+// they happen. Implements pointWriter, EventHandler and http.Handler.
+type Prometheus struct {
+	mu        sync.Mutex
+	tracker   []metricPoint // The last tick's, one per target.
+	processes []metricPoint
+	ticks     map[string]uint64 // By target.
+	quits     map[string]uint64
+	kills     map[string]uint64
+
+	// Optional counters kept elsewhere.
+	ParseErrors  func() uint64
+	HookFailures func() uint64
+}
+
+// NewPrometheus returns an exporter with nothing to export, until the first
+// tick's points are written to it.
+func NewPrometheus() *Prometheus {
+	return &Prometheus{
+		ticks: make(map[string]uint64),
+		quits: make(map[string]uint64),
+		kills: make(map[string]uint64),
+	}
+}
+
+// WritePoints takes a tick's points, replacing the last tick's.
+func (p *Prometheus) WritePoints(points []metricPoint) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tracker, p.processes = nil, nil
+	for _, pt := range points {
+		switch pt.Name {
+		case "tracker":
+			p.tracker = append(p.tracker, pt)
+			p.ticks[pt.Tags["target"]]++
+		case "process":
+			p.processes = append(p.processes, pt)
+		}
+	}
+	return nil
+}
+
+func (p *Prometheus) HandleEvent(e Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch e.Type {
+	case EventClosing:
+		p.quits[e.Target]++
+	case EventKilled:
+		p.kills[e.Target]++
+	}
+}
+
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.Export(w)
+}
+
+// Export writes all the metrics in the Prometheus text format.
+func (p *Prometheus) Export(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, g := range prometheusGauges {
+		writePrometheusHeader(w, g.name, "gauge", g.help)
+		for _, pt := range p.tracker {
+			writePrometheusSample(w, g.name, prometheusLabels{"target": pt.Tags["target"]}, pt.Fields[g.field])
+		}
+	}
+	writePrometheusHeader(w, "player_state", "gauge", "The player's state, 1 for the current one.")
+	for _, pt := range p.tracker {
+		for _, state := range prometheusStates {
+			labels := prometheusLabels{"target": pt.Tags["target"], "state": state}
+			writePrometheusSample(w, "player_state", labels, pt.Tags["player_state"] == state)
+		}
+	}
+	for _, g := range prometheusProcessGauges {
+		writePrometheusHeader(w, g.name, "gauge", g.help)
+		for _, pt := range p.processes {
+			labels := prometheusLabels{"target": pt.Tags["target"], "command": pt.Tags["command"], "pid": pt.Tags["pid"]}
+			writePrometheusSample(w, g.name, labels, pt.Fields[g.field])
+		}
+	}
+	writePrometheusCounter(w, "ticks_total", "Ticks observed.", p.ticks)
+	writePrometheusCounter(w, "quits_requested_total", "Times the target was told to quit.", p.quits)
+	writePrometheusCounter(w, "kills_total", "Times the target was killed.", p.kills)
+	if p.ParseErrors != nil {
+		writePrometheusHeader(w, "parse_errors_total", "counter", "Processes whose stats couldn't be parsed.")
+		writePrometheusSample(w, "parse_errors_total", nil, p.ParseErrors())
+	}
+	if p.HookFailures != nil {
+		writePrometheusHeader(w, "hook_failures_total", "counter", "Hooks that failed or timed out.")
+		writePrometheusSample(w, "hook_failures_total", nil, p.HookFailures())
+	}
+}
+
+var prometheusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// prometheusLabels are written sorted by name, so the output is stable.
+type prometheusLabels map[string]string
+
+func (l prometheusLabels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + prometheusEscaper.Replace(l[name]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writePrometheusHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP spotifywatcher_%s %s\n# TYPE spotifywatcher_%s %s\n", name, help, name, kind)
+}
+
+func writePrometheusCounter(w io.Writer, name, help string, byTarget map[string]uint64) {
+	writePrometheusHeader(w, name, "counter", help)
+	targets := make([]string, 0, len(byTarget))
+	for target := range byTarget {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		writePrometheusSample(w, name, prometheusLabels{"target": target}, byTarget[target])
+	}
+}
+
+// writePrometheusSample writes a sample, if its value is a number or a bool.
+func writePrometheusSample(w io.Writer, name string, labels prometheusLabels, value interface{}) {
+	var v float64
+	switch value := value.(type) {
+	case float64:
+		v = value
+	case int:
+		v = float64(value)
+	case int64:
+		v = float64(value)
+	case uint64:
+		v = float64(value)
+	case bool:
+		if value {
+			v = 1
+		}
+	default:
+		return
+	}
+	fmt.Fprintf(w, "spotifywatcher_%s%s %g\n", name, labels, v)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheus(t *testing.T) {
+	p := NewPrometheus()
+	p.ParseErrors = func() uint64 { return 2 }
+	now := time.Now()
+	tick := []metricPoint{
+		{"tracker", metricTags{"target": "Spotify", "player_state": "paused"}, metricFields{
+			"cpu": 12.5, "median": 9.0, "samples": 5, "breaches": 3, "throttled": true, "state_errors": int64(1),
+		}, now},
+		{"metrics", metricTags{"target": "Spotify"}, metricFields{"queued": int64(7)}, now},
+		{"process", metricTags{"target": "Spotify", "command": "Spotify", "pid": "42"}, metricFields{
+			"cpu": 12.5, "threads": 30, "pageins": 4, "state": "S",
+		}, now},
+	}
+	p.WritePoints(tick)
+	p.WritePoints(tick)
+	p.HandleEvent(Event{Type: EventClosing, Target: "Spotify"})
+	p.HandleEvent(Event{Type: EventMisbehaving, Target: "Spotify"})
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("got content type %q", resp.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{
+		`# TYPE spotifywatcher_cpu_percent gauge`,
+		`spotifywatcher_cpu_percent{target="Spotify"} 12.5`,
+		`spotifywatcher_breaches{target="Spotify"} 3`,
+		`spotifywatcher_throttled{target="Spotify"} 1`,
+		`spotifywatcher_samples{target="Spotify"} 5`,
+		`spotifywatcher_player_state{state="paused",target="Spotify"} 1`,
+		`spotifywatcher_player_state{state="playing",target="Spotify"} 0`,
+		`spotifywatcher_process_threads{command="Spotify",pid="42",target="Spotify"} 30`,
+		`spotifywatcher_process_pageins{command="Spotify",pid="42",target="Spotify"} 4`,
+		`# TYPE spotifywatcher_ticks_total counter`,
+		`spotifywatcher_ticks_total{target="Spotify"} 2`,
+		`spotifywatcher_quits_requested_total{target="Spotify"} 1`,
+		`spotifywatcher_parse_errors_total 2`,
+	} {
+		if !strings.Contains(string(body), want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+	for _, unwanted := range []string{"spotifywatcher_kills_total{", "hook_failures", "queued", `"S"`} {
+		if strings.Contains(string(body), unwanted) {
+			t.Errorf("unexpected %q in:\n%s", unwanted, body)
+		}
+	}
+}
+
+func TestPrometheusLabels(t *testing.T) {
+	labels := prometheusLabels{"pid": "1", "command": "Spotify \"Helper\"\\\n"}
+	want := `{command="Spotify \"Helper\"\\\n",pid="1"}`
+	if labels.String() != want {
+		t.Errorf("got %s, want %s", labels, want)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Protocol buffer wire types.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+// protoMessage is an encoded protocol buffer message, built up a field at a
+// time. It's just enough of the wire format to speak OTLP without its
+// generated code.
+type protoMessage []byte
+
+func (m *protoMessage) tag(field, wireType int) {
+	m.uvarint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (m *protoMessage) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	*m = append(*m, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// Varint adds an integer, bool or enum field.
+func (m *protoMessage) Varint(field int, v uint64) {
+	m.tag(field, protoVarint)
+	m.uvarint(v)
+}
+
+// Fixed64 adds a fixed64 or sfixed64 field.
+func (m *protoMessage) Fixed64(field int, v uint64) {
+	m.tag(field, protoFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	*m = append(*m, buf[:]...)
+}
+
+// Double adds a double field.
+func (m *protoMessage) Double(field int, v float64) {
+	m.Fixed64(field, math.Float64bits(v))
+}
+
+// Bytes adds a bytes field, or an embedded message.
+func (m *protoMessage) Bytes(field int, b []byte) {
+	m.tag(field, protoBytes)
+	m.uvarint(uint64(len(b)))
+	*m = append(*m, b...)
+}
+
+// String adds a string field.
+func (m *protoMessage) String(field int, s string) {
+	m.Bytes(field, []byte(s))
+}
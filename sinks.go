@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// MetricSink sends each tick's metrics, and the tracker's events, somewhere.
+// Each tick begins with BeginTick, then has its points added, and ends with
+// Flush. Events may be added at any time, and AddEvent must not block.
+type MetricSink interface {
+	BeginTick(now time.Time)
+	AddTracker(p metricPoint)
+	AddProcess(p metricPoint)
+	AddEvent(e Event)
+	Flush() error
+	Close() error
+}
+
+// metricSinks sends everything to every sink. Implements MetricSink and
+// EventHandler.
+type metricSinks []MetricSink
+
+func (ss metricSinks) BeginTick(now time.Time) {
+	for _, s := range ss {
+		s.BeginTick(now)
+	}
+}
+
+func (ss metricSinks) AddTracker(p metricPoint) {
+	for _, s := range ss {
+		s.AddTracker(p)
+	}
+}
+
+func (ss metricSinks) AddProcess(p metricPoint) {
+	for _, s := range ss {
+		s.AddProcess(p)
+	}
+}
+
+func (ss metricSinks) AddEvent(e Event) {
+	for _, s := range ss {
+		s.AddEvent(e)
+	}
+}
+
+func (ss metricSinks) HandleEvent(e Event) {
+	ss.AddEvent(e)
+}
+
+// Flush flushes every sink, even if some fail.
+func (ss metricSinks) Flush() error {
+	return ss.each(MetricSink.Flush)
+}
+
+// Close closes every sink, even if some fail.
+func (ss metricSinks) Close() error {
+	return ss.each(MetricSink.Close)
+}
+
+func (ss metricSinks) each(do func(MetricSink) error) error {
+	var errs []string
+	for _, s := range ss {
+		if err := do(s); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// pointSink makes a MetricSink of a pointWriter, writing each tick's points
+// together when it's flushed. Events are passed to the handler, if there is
+// one. Closing the sink closes the writer and handler, if they can be.
+type pointSink struct {
+	name   string
+	writer pointWriter
+	events EventHandler // Optional.
+	points []metricPoint
+}
+
+func (s *pointSink) BeginTick(now time.Time) {
+	s.points = nil // Not reused, as writers may hold on to them.
+}
+
+func (s *pointSink) AddTracker(p metricPoint) {
+	s.points = append(s.points, p)
+}
+
+func (s *pointSink) AddProcess(p metricPoint) {
+	s.points = append(s.points, p)
+}
+
+func (s *pointSink) AddEvent(e Event) {
+	if s.events != nil {
+		s.events.HandleEvent(e)
+	}
+}
+
+func (s *pointSink) Flush() error {
+	if err := s.writer.WritePoints(s.points); err != nil {
+		return fmt.Errorf("%s: %v", s.name, err)
+	}
+	return nil
+}
+
+func (s *pointSink) Close() error {
+	var err error
+	if c, ok := s.writer.(io.Closer); ok {
+		err = c.Close()
+	}
+	if c, ok := s.events.(io.Closer); ok && interface{}(s.events) != interface{}(s.writer) {
+		if e := c.Close(); err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.name, err)
+	}
+	return nil
+}
+
+// pointEvents adds each event to a queue, as an "events" point tagged with the
+// type of event, and the given tags. Implements EventHandler.
+type pointEvents struct {
+	queue *MetricsQueue
+	tags  metricTags
+}
+
+func (pe pointEvents) HandleEvent(e Event) {
+	tags := metricTags{"target": e.Target, "event": string(e.Type), "player_state": string(e.State)}
+	for k, v := range pe.tags {
+		tags[k] = v
+	}
+	fields := metricFields{
+		"pid":       e.Pid,
+		"cpu":       e.Cpu,
+		"median":    e.Median,
+		"samples":   e.Samples,
+		"breaches":  e.Breaches,
+		"threshold": e.Threshold,
+		"dry_run":   e.DryRun,
+	}
+	if e.Track != (Track{}) {
+		fields["track_name"] = e.Track.Name
+		fields["track_artist"] = e.Track.Artist
+		fields["track_album"] = e.Track.Album
+		fields["track_uri"] = e.Track.URI
+	}
+	pe.queue.Add(metricPoint{"events", tags, fields, e.Time})
+}
+
+// newMetricSinks returns the sinks enabled by the options: InfluxDB,
+// Prometheus, StatsD, OTLP, the local history and the export file. Prometheus
+// counts the parse errors of top, and the failures of hooks, if any are run.
+func newMetricSinks(top *Top, hooks *HookRunner) (sinks metricSinks, err error) {
+	flush := time.Duration(opts.MetricsFlush) * time.Second
+	host, _ := os.Hostname()
+	influx, err := influxConfigFromOptions()
+	if err != nil {
+		return nil, err
+	}
+	influxAgent, err := newInfluxAgent(influx)
+	if err != nil {
+		return nil, err
+	}
+	if influxAgent != nil {
+		spool, err := openMetricsSpool(expandHome(opts.MetricsSpool), opts.MetricsSpoolMax)
+		if err != nil {
+			return nil, err
+		}
+		queue := NewMetricsQueue(influxAgent, spool, opts.MetricsBatch, flush)
+		events := pointEvents{queue: queue, tags: metricTags{}}
+		if host != "" {
+			events.tags["host"] = host
+		}
+		sinks = append(sinks, &pointSink{name: "InfluxDB", writer: queue, events: events})
+	}
+	if opts.Prometheus != "" {
+		prom := NewPrometheus()
+		prom.ParseErrors = top.ParseErrors
+		if hooks != nil {
+			prom.HookFailures = hooks.Failures
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", prom)
+		go func() {
+			fatal(http.ListenAndServe(opts.Prometheus, mux))
+		}()
+		sinks = append(sinks, &pointSink{name: "Prometheus", writer: prom, events: prom})
+	}
+	if opts.Statsd != "" {
+		statsd, err := NewStatsD(opts.Statsd, opts.StatsdPrefix, opts.StatsdTags, opts.StatsdRate)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, &pointSink{name: "StatsD", writer: statsd, events: statsd})
+	}
+	if opts.OTLP != "" {
+		resource := map[string]string{
+			"service.name":          "spotifywatcher",
+			"service.version":       version,
+			"spotifywatcher.target": spotifyCommand,
+		}
+		if host != "" {
+			resource["host.name"] = host
+		}
+		otlp, err := NewOTLP(opts.OTLP, opts.OTLPProtocol, opts.OTLPHeader, resource, 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		queue := NewMetricsQueue(otlp, nil, opts.MetricsBatch, flush)
+		sinks = append(sinks, &pointSink{name: "OTLP", writer: queue, events: otlp})
+	}
+	if opts.KeepHistory {
+		history, err := OpenHistoryStore(expandHome(opts.HistoryDir),
+			time.Duration(opts.TopInterval)*time.Second,
+			time.Duration(opts.HistoryRaw)*24*time.Hour,
+			time.Duration(opts.HistoryDays)*24*time.Hour)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, history)
+	}
+	if opts.Export != "" {
+		export, err := OpenExport(expandHome(opts.Export), opts.Format, opts.ExportGzip, int64(opts.ExportSize)<<20)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, export)
+	}
+	return sinks, nil
+}
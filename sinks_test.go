@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeSink records what it's told to do, and fails to flush when it's down.
+type fakeSink struct {
+	calls []string
+	down  bool
+}
+
+func (s *fakeSink) BeginTick(now time.Time)  { s.calls = append(s.calls, "begin") }
+func (s *fakeSink) AddTracker(p metricPoint) { s.calls = append(s.calls, "tracker") }
+func (s *fakeSink) AddProcess(p metricPoint) { s.calls = append(s.calls, "process "+p.Tags["pid"]) }
+func (s *fakeSink) AddEvent(e Event)         { s.calls = append(s.calls, "event "+string(e.Type)) }
+func (s *fakeSink) Close() error             { s.calls = append(s.calls, "close"); return nil }
+
+func (s *fakeSink) Flush() error {
+	s.calls = append(s.calls, "flush")
+	if s.down {
+		return errors.New("down")
+	}
+	return nil
+}
+
+func TestMetricSinks(t *testing.T) {
+	up, down := &fakeSink{}, &fakeSink{down: true}
+	sinks := metricSinks{down, up}
+	sinks.BeginTick(time.Unix(3, 0))
+	sinks.AddTracker(testPoint(1))
+	sinks.AddProcess(metricPoint{"process", metricTags{"pid": "42"}, nil, time.Unix(3, 0)})
+	sinks.HandleEvent(Event{Type: EventKilled})
+	if err := sinks.Flush(); err == nil || err.Error() != "down" {
+		t.Errorf("got %v, want the down sink's error", err)
+	}
+	if err := sinks.Close(); err != nil {
+		t.Error(err)
+	}
+	want := []string{"begin", "tracker", "process 42", "event killed", "flush", "close"}
+	for _, s := range sinks {
+		if calls := s.(*fakeSink).calls; !reflect.DeepEqual(calls, want) {
+			t.Errorf("got %v, want %v", calls, want)
+		}
+	}
+}
+
+func TestPointSink(t *testing.T) {
+	w := &fakePointWriter{}
+	events := &eventRecorder{}
+	s := &pointSink{name: "fake", writer: w, events: events}
+	for tick := 1; tick <= 2; tick++ {
+		s.BeginTick(time.Unix(int64(tick), 0))
+		s.AddTracker(testPoint(tick))
+		s.AddEvent(Event{Type: EventMisbehaving})
+		if err := s.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := w.written(), []metricPoint{testPoint(1), testPoint(2)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(events.types()) != 2 {
+		t.Errorf("got events %v, want 2", events.types())
+	}
+	w.setDown(true)
+	if err := s.Flush(); err == nil || err.Error() != "fake: connection refused" {
+		t.Errorf("got %v, want the writer's error", err)
+	}
+}
+
+func TestPointEvents(t *testing.T) {
+	w := &fakePointWriter{}
+	q := NewMetricsQueue(w, nil, 100, time.Hour)
+	events := pointEvents{queue: q, tags: metricTags{"host": "mac"}}
+	events.HandleEvent(Event{Type: EventKilled, Time: time.Unix(3, 0), Target: "Spotify", Pid: "42", State: StateClosing, Cpu: 20})
+	q.Close()
+	want := []metricPoint{{"events", metricTags{"target": "Spotify", "host": "mac", "event": "killed", "player_state": "closing"}, metricFields{
+		"pid": "42", "cpu": 20.0, "median": 0.0, "samples": 0, "breaches": 0, "threshold": 0.0, "dry_run": false,
+	}, time.Unix(3, 0)}}
+	if got := w.written(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMetricsQueueCloses(t *testing.T) {
+	w := &fakePointWriter{}
+	q := NewMetricsQueue(w, nil, 100, time.Hour)
+	q.WritePoints([]metricPoint{testPoint(1)})
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	written := w.written()
+	if len(written) != 2 || written[1].Name != "metrics" || written[1].Tags["target"] != "Spotify" {
+		t.Fatalf("got %v, want the point and a metrics point", written)
+	}
+	if queued := written[1].Fields["queued"]; queued != int64(0) {
+		t.Errorf("got %v queued, want 0 before the point was added", queued)
+	}
+}
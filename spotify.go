@@ -0,0 +1,20 @@
+package main
+
+type State string
+
+const (
+	StateUnknown    State = ""
+	StateForeground State = "foreground"
+	StateStopped    State = "stopped"
+	StatePlaying    State = "playing"
+	StatePaused     State = "paused"
+	StateClosing    State = "closing"
+	StateClosed     State = "closed"
+)
+
+func (s State) String() string {
+	if s == StateUnknown {
+		return "(unknown)"
+	}
+	return string(s)
+}
@@ -0,0 +1,148 @@
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	mprisSpotify = "org.mpris.MediaPlayer2.spotify"
+	mprisPath    = "/org/mpris/MediaPlayer2"
+	mprisRoot    = "org.mpris.MediaPlayer2"
+	mprisPlayer  = "org.mpris.MediaPlayer2.Player"
+)
+
+// MPRIS controls a media player over D-Bus, through its MPRIS interface.
+type MPRIS struct {
+	conn    *dbus.Conn
+	dest    string
+	windows ActiveWindow
+}
+
+// NewMPRIS returns a controller for the player owning the bus name dest, such
+// as "org.mpris.MediaPlayer2.spotify". If windows is given, the player is in
+// the foreground when its process (or a child) owns the active window.
+func NewMPRIS(conn *dbus.Conn, dest string, windows ActiveWindow) *MPRIS {
+	return &MPRIS{conn: conn, dest: dest, windows: windows}
+}
+
+func (m *MPRIS) object() dbus.BusObject {
+	return m.conn.Object(m.dest, mprisPath)
+}
+
+func (m *MPRIS) call(ctx context.Context, method string) error {
+	return m.object().CallWithContext(ctx, method, 0).Err
+}
+
+func (m *MPRIS) property(ctx context.Context, name string) (v dbus.Variant, err error) {
+	err = m.object().CallWithContext(ctx, "org.freedesktop.DBus.Properties.Get", 0, mprisPlayer, name).Store(&v)
+	return
+}
+
+// isClosed returns whether the error means the player isn't on the bus.
+func isClosed(err error) bool {
+	if e, ok := err.(dbus.Error); ok {
+		return e.Name == "org.freedesktop.DBus.Error.ServiceUnknown" ||
+			e.Name == "org.freedesktop.DBus.Error.NameHasNoOwner"
+	}
+	return false
+}
+
+// foreground returns whether the player owns the active window. Not being able
+// to tell (no window manager, Wayland, etc.) means it isn't.
+func (m *MPRIS) foreground(ctx context.Context) bool {
+	if m.windows == nil {
+		return false
+	}
+	var owner uint32
+	err := m.conn.BusObject().CallWithContext(ctx, "org.freedesktop.DBus.GetConnectionUnixProcessID", 0, m.dest).Store(&owner)
+	if err != nil {
+		return false
+	}
+	pid, err := m.windows.Pid(ctx)
+	if err != nil {
+		return false
+	}
+	return inProcessTree(int(owner), pid)
+}
+
+// State returns whether the player is in the foreground, playing, paused,
+// stopped or closed.
+func (m *MPRIS) State(ctx context.Context) (s State, err error) {
+	v, err := m.property(ctx, "PlaybackStatus")
+	if isClosed(err) {
+		return StateClosed, nil
+	}
+	if err != nil {
+		return
+	}
+	status, _ := v.Value().(string)
+	switch status {
+	case "Playing":
+		s = StatePlaying
+	case "Paused":
+		s = StatePaused
+	case "Stopped":
+		s = StateStopped
+	default:
+		err = fmt.Errorf("unknown state: bad PlaybackStatus %q", status)
+		return
+	}
+	if m.foreground(ctx) {
+		s = StateForeground
+	}
+	return
+}
+
+// Quit asks the player to quit.
+func (m *MPRIS) Quit(ctx context.Context) error {
+	return m.call(ctx, mprisRoot+".Quit")
+}
+
+// Pause pauses playback, if playing.
+func (m *MPRIS) Pause(ctx context.Context) error {
+	return m.call(ctx, mprisPlayer+".Pause")
+}
+
+// Play starts or resumes playback.
+func (m *MPRIS) Play(ctx context.Context) error {
+	return m.call(ctx, mprisPlayer+".Play")
+}
+
+// NowPlaying returns the current track, from the player's xesam metadata.
+func (m *MPRIS) NowPlaying(ctx context.Context) (t Track, err error) {
+	v, err := m.property(ctx, "Metadata")
+	if isClosed(err) {
+		return t, nil
+	}
+	if err != nil {
+		return
+	}
+	metadata, _ := v.Value().(map[string]dbus.Variant)
+	str := func(key string) string {
+		s, _ := metadata[key].Value().(string)
+		return s
+	}
+	t.Name = str("xesam:title")
+	t.Album = str("xesam:album")
+	t.URI = str("xesam:url")
+	if artists, ok := metadata["xesam:artist"].Value().([]string); ok {
+		t.Artist = strings.Join(artists, ", ")
+	}
+	return t, nil
+}
+
+// newPlayer returns Spotify on the session bus, in the foreground when its
+// window is active on the X display.
+func newPlayer() (Player, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, err
+	}
+	return NewMPRIS(conn, mprisSpotify, newActiveWindow()), nil
+}
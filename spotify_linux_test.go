@@ -0,0 +1,237 @@
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const testBusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:dir=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>`
+
+// privateBus starts a dbus-daemon of our own, returning its address. The test
+// is skipped if there's no dbus-daemon to run.
+func privateBus(t *testing.T) (addr string, cleanup func()) {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+	dir, err := ioutil.TempDir("", "dbus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "session.conf")
+	if err := ioutil.WriteFile(config, []byte(strings.Replace(testBusConfig, "%s", dir, 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	addr, err = bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		cmd.Process.Kill()
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(addr), func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+}
+
+// fakeMPRIS is a stand-in for Spotify on the bus. Its methods are called from
+// the bus connection's goroutines.
+type fakeMPRIS struct {
+	props  *prop.Properties
+	mu     sync.Mutex
+	quit   bool
+	paused bool
+}
+
+func (f *fakeMPRIS) Quit() *dbus.Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.quit = true
+	return nil
+}
+
+func (f *fakeMPRIS) Play() *dbus.Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paused = false
+	f.props.SetMust(mprisPlayer, "PlaybackStatus", "Playing")
+	return nil
+}
+
+func (f *fakeMPRIS) Pause() *dbus.Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paused = true
+	f.props.SetMust(mprisPlayer, "PlaybackStatus", "Paused")
+	return nil
+}
+
+func (f *fakeMPRIS) status() (quit, paused bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.quit, f.paused
+}
+
+func exportFakeMPRIS(t *testing.T, addr, status string) (*fakeMPRIS, *dbus.Conn) {
+	conn, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := conn.RequestName(mprisSpotify, dbus.NameFlagDoNotQueue); err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("couldn't own %s: %v", mprisSpotify, err)
+	}
+	f := &fakeMPRIS{}
+	f.mu.Lock() // Until the properties are exported.
+	defer f.mu.Unlock()
+	conn.ExportMethodTable(map[string]interface{}{"Quit": f.Quit}, mprisPath, mprisRoot)
+	conn.ExportMethodTable(map[string]interface{}{"Pause": f.Pause, "Play": f.Play}, mprisPath, mprisPlayer)
+	f.props, err = prop.Export(conn, mprisPath, prop.Map{
+		mprisPlayer: {
+			"PlaybackStatus": {Value: status, Writable: true, Emit: prop.EmitTrue},
+			"Metadata": {Value: map[string]dbus.Variant{
+				"xesam:title":  dbus.MakeVariant("Windowlicker"),
+				"xesam:artist": dbus.MakeVariant([]string{"Aphex Twin"}),
+				"xesam:album":  dbus.MakeVariant("Windowlicker"),
+				"xesam:url":    dbus.MakeVariant("https://open.spotify.com/track/5qMZ8wBOPvOUVVmr2JGbmG"),
+			}, Emit: prop.EmitTrue},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, conn
+}
+
+func TestMPRISState(t *testing.T) {
+	addr, cleanup := privateBus(t)
+	defer cleanup()
+
+	conn, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m := NewMPRIS(conn, mprisSpotify, nil)
+
+	if s, err := m.State(context.Background()); err != nil || s != StateClosed {
+		t.Errorf("no player: got %s (%v), want %s", s, err, StateClosed)
+	}
+
+	fake, service := exportFakeMPRIS(t, addr, "Playing")
+	defer service.Close()
+	for _, tt := range []struct {
+		status string
+		state  State
+	}{
+		{"Playing", StatePlaying},
+		{"Paused", StatePaused},
+		{"Stopped", StateStopped},
+	} {
+		fake.props.SetMust(mprisPlayer, "PlaybackStatus", tt.status)
+		if s, err := m.State(context.Background()); err != nil || s != tt.state {
+			t.Errorf("%s: got %s (%v), want %s", tt.status, s, err, tt.state)
+		}
+	}
+	fake.props.SetMust(mprisPlayer, "PlaybackStatus", "Rewinding")
+	if _, err := m.State(context.Background()); err == nil {
+		t.Error("expected error for unknown PlaybackStatus")
+	}
+}
+
+func TestMPRISPauseAndQuit(t *testing.T) {
+	addr, cleanup := privateBus(t)
+	defer cleanup()
+
+	fake, service := exportFakeMPRIS(t, addr, "Playing")
+	defer service.Close()
+	conn, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m := NewMPRIS(conn, mprisSpotify, nil)
+
+	if err := m.Pause(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, paused := fake.status(); !paused {
+		t.Error("player wasn't paused")
+	}
+	if s, _ := m.State(context.Background()); s != StatePaused {
+		t.Errorf("got %s, want %s", s, StatePaused)
+	}
+	if err := m.Play(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, paused := fake.status(); paused {
+		t.Error("player wasn't played")
+	}
+	if s, _ := m.State(context.Background()); s != StatePlaying {
+		t.Errorf("got %s, want %s", s, StatePlaying)
+	}
+	if err := m.Quit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if quit, _ := fake.status(); !quit {
+		t.Error("player wasn't told to quit")
+	}
+}
+
+func TestMPRISNowPlaying(t *testing.T) {
+	addr, cleanup := privateBus(t)
+	defer cleanup()
+
+	conn, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m := NewMPRIS(conn, mprisSpotify, nil)
+
+	if track, err := m.NowPlaying(context.Background()); err != nil || track != (Track{}) {
+		t.Errorf("no player: got %+v (%v), want nothing", track, err)
+	}
+
+	_, service := exportFakeMPRIS(t, addr, "Playing")
+	defer service.Close()
+	want := Track{
+		Name:   "Windowlicker",
+		Artist: "Aphex Twin",
+		Album:  "Windowlicker",
+		URI:    "https://open.spotify.com/track/5qMZ8wBOPvOUVVmr2JGbmG",
+	}
+	if track, err := m.NowPlaying(context.Background()); err != nil || track != want {
+		t.Errorf("got %+v (%v), want %+v", track, err, want)
+	}
+}
@@ -4,34 +4,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"os/exec"
+	"strconv"
 	"strings"
 )
 
-type State string
-
-const (
-	StateUnknown    State = ""
-	StateForeground State = "foreground"
-	StateStopped    State = "stopped"
-	StatePlaying    State = "playing"
-	StatePaused     State = "paused"
-	StateClosing    State = "closing"
-	StateClosed     State = "closed"
-)
-
-func (s State) String() string {
-	if s == StateUnknown {
-		return "(unknown)"
-	}
-	return string(s)
-}
-
-func osascript(script string) *exec.Cmd {
+func osascript(ctx context.Context, script string) *exec.Cmd {
 	var buf bytes.Buffer
 	buf.WriteString(strings.TrimSpace(script))
-	cmd := exec.Command("/usr/bin/osascript")
+	cmd := exec.CommandContext(ctx, "/usr/bin/osascript")
 	cmd.Stdin = &buf
 	return cmd
 }
@@ -49,8 +32,11 @@ else
 end if
 `
 
-func SpotifyState() (s State, err error) {
-	out, err := osascript(checkStateScript).CombinedOutput()
+// AppleScript controls the Spotify app through osascript. Implements Player.
+type AppleScript struct{}
+
+func (AppleScript) State(ctx context.Context) (s State, err error) {
+	out, err := osascript(ctx, checkStateScript).CombinedOutput()
 	if err != nil {
 		return
 	}
@@ -71,6 +57,63 @@ func SpotifyState() (s State, err error) {
 	return
 }
 
-func TellSpotifyToQuit() error {
-	return osascript(`tell application "Spotify" to quit`).Run()
+func (AppleScript) Quit(ctx context.Context) error {
+	return osascript(ctx, `tell application "Spotify" to quit`).Run()
+}
+
+// Telling Spotify to do anything launches it, if it isn't running already.
+func ifRunning(command string) string {
+	return `if application "Spotify" is running then tell application "Spotify" to ` + command
+}
+
+func (AppleScript) Pause(ctx context.Context) error {
+	return osascript(ctx, ifRunning("pause")).Run()
+}
+
+func (AppleScript) Play(ctx context.Context) error {
+	return osascript(ctx, ifRunning("play")).Run()
+}
+
+var nowPlayingScript = `
+if application "Spotify" is running then
+	tell application "Spotify"
+		if player state is stopped then
+			return ""
+		end if
+		set t to current track
+		return (name of t) & linefeed & (artist of t) & linefeed & (album of t) & linefeed & (spotify url of t)
+	end tell
+end if
+`
+
+func (AppleScript) NowPlaying(ctx context.Context) (t Track, err error) {
+	out, err := osascript(ctx, nowPlayingScript).Output()
+	if err != nil {
+		return
+	}
+	fields := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	if len(fields) < 4 {
+		return // Nothing playing.
+	}
+	return Track{Name: fields[0], Artist: fields[1], Album: fields[2], URI: fields[3]}, nil
+}
+
+// SystemEvents finds the frontmost app through System Events, so that it works
+// even when Spotify can't answer. Implements ActiveWindow.
+type SystemEvents struct{}
+
+func (SystemEvents) Pid(ctx context.Context) (int, error) {
+	out, err := osascript(ctx, `tell application "System Events" to return unix id of first process whose frontmost is true`).Output()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
+
+func newActiveWindow() ActiveWindow {
+	return SystemEvents{}
+}
+
+func newPlayer() (Player, error) {
+	return AppleScript{}, nil
 }
@@ -0,0 +1,13 @@
+// +build !darwin,!linux
+
+package main
+
+import "errors"
+
+func newPlayer() (Player, error) {
+	return nil, errors.New("Controlling Spotify is only supported on macOS and Linux")
+}
+
+func newActiveWindow() ActiveWindow {
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// statsdGauges are the process fields sent as gauges.
+var statsdGauges = []string{"cpu", "threads", "pageins"}
+
+// StatsD sends process metrics as gauges, and tracker events as counters, to a
+// StatsD agent over UDP. Plain StatsD has no tags, so metrics are named for the
+// target and command, e.g. "spotifywatcher.Spotify.Spotify_Helper.cpu", and the
+// processes sharing a command are summed. With DogStatsD tags, they're named
+// e.g. "spotifywatcher.process.cpu" and tagged with the target, host, command
+// and pid instead. Implements pointWriter and EventHandler.
+type StatsD struct {
+	conn   net.Conn
+	prefix string
+	tags   bool    // DogStatsD tag extensions.
+	rate   float64 // Sample rate, from 0 to 1.
+	sample func() float64
+}
+
+// NewStatsD returns a sink for the agent at addr, e.g. localhost:8125.
+func NewStatsD(addr, prefix string, tags bool, rate float64) (*StatsD, error) {
+	if rate <= 0 || rate > 1 {
+		return nil, fmt.Errorf("invalid StatsD sample rate %v, expected more than 0 and at most 1", rate)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsD{conn: conn, prefix: prefix, tags: tags, rate: rate, sample: rand.Float64}, nil
+}
+
+// WritePoints sends a gauge for each process field.
+func (s *StatsD) WritePoints(points []metricPoint) error {
+	var lines []string
+	if s.tags {
+		for _, p := range points {
+			if p.Name != "process" {
+				continue
+			}
+			tags := statsdTags(p.Tags, "target", "host", "command", "pid", "player_state")
+			for _, field := range statsdGauges {
+				if v, ok := statsdValue(p.Fields[field]); ok {
+					lines = s.appendLine(lines, "process."+field, v, "g", tags)
+				}
+			}
+		}
+		return writeDatagrams(s.conn, lines)
+	}
+	sums := make(map[string]float64)
+	for _, p := range points {
+		if p.Name != "process" {
+			continue
+		}
+		name := statsdName(p.Tags["target"]) + "." + statsdName(p.Tags["command"]) + "."
+		for _, field := range statsdGauges {
+			if v, ok := statsdValue(p.Fields[field]); ok {
+				sums[name+field] += v
+			}
+		}
+	}
+	for _, name := range sortedFloatKeys(sums) {
+		lines = s.appendLine(lines, name, sums[name], "g", "")
+	}
+	return writeDatagrams(s.conn, lines)
+}
+
+// HandleEvent counts the event, e.g. as "spotifywatcher.Spotify.events.closing".
+func (s *StatsD) HandleEvent(e Event) {
+	name := statsdName(e.Target) + ".events." + string(e.Type)
+	tags := ""
+	if s.tags {
+		name = "events." + string(e.Type)
+		tags = statsdTags(map[string]string{"target": e.Target}, "target")
+	}
+	if err := writeDatagrams(s.conn, s.appendLine(nil, name, 1, "c", tags)); err != nil {
+		log.Printf("Failed to send %q event to StatsD: %v\n", e.Type, err)
+	}
+}
+
+// Close stops sending to the agent.
+func (s *StatsD) Close() error {
+	return s.conn.Close()
+}
+
+// appendLine adds a metric to the lines, if it's sampled.
+func (s *StatsD) appendLine(lines []string, name string, value float64, kind, tags string) []string {
+	if s.rate < 1 && s.sample() >= s.rate {
+		return lines
+	}
+	if s.prefix != "" {
+		name = s.prefix + "." + name
+	}
+	line := name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind
+	if s.rate < 1 {
+		line += "|@" + strconv.FormatFloat(s.rate, 'f', -1, 64)
+	}
+	if tags != "" {
+		line += "|#" + tags
+	}
+	return append(lines, line)
+}
+
+var statsdUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// statsdName makes a name safe to use as part of a metric name.
+func statsdName(name string) string {
+	return strings.Trim(statsdUnsafe.ReplaceAllString(name, "_"), "_")
+}
+
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// statsdTags returns the named tags which are set, in DogStatsD form.
+func statsdTags(tags map[string]string, names ...string) string {
+	var pairs []string
+	for _, name := range names {
+		if v := tags[name]; v != "" {
+			pairs = append(pairs, name+":"+statsdTagEscaper.Replace(v))
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// statsdValue returns a field's value, if it's a number.
+func statsdValue(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	}
+	return 0, false
+}
+
+func sortedFloatKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statsdListener returns a StatsD agent to send to, and a way to read the
+// lines it's been sent.
+func statsdListener(t *testing.T) (addr string, read func(n int) []string, cleanup func()) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read = func(n int) (lines []string) {
+		buf := make([]byte, 64*1024)
+		listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for len(lines) < n {
+			m, _, err := listener.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("got %d lines %q: %v", len(lines), lines, err)
+			}
+			lines = append(lines, strings.Split(strings.TrimSuffix(string(buf[:m]), "\n"), "\n")...)
+		}
+		sort.Strings(lines)
+		return
+	}
+	return listener.LocalAddr().String(), read, func() { listener.Close() }
+}
+
+var statsdTestPoints = []metricPoint{
+	{"tracker", metricTags{"target": "Spotify"}, metricFields{"cpu": 20.0}, time.Unix(3, 0)},
+	{"process", metricTags{"target": "Spotify", "host": "mac", "command": "Spotify", "pid": "1", "player_state": "paused"}, metricFields{
+		"cpu": 12.5, "threads": 30, "pageins": 4, "state": "S",
+	}, time.Unix(3, 0)},
+	{"process", metricTags{"target": "Spotify", "host": "mac", "command": "Spotify Helper (renderer)", "pid": "2"}, metricFields{
+		"cpu": 1.5, "threads": 10, "pageins": 0,
+	}, time.Unix(3, 0)},
+	{"process", metricTags{"target": "Spotify", "host": "mac", "command": "Spotify Helper (renderer)", "pid": "3"}, metricFields{
+		"cpu": 2.0, "threads": 12, "pageins": 1,
+	}, time.Unix(3, 0)},
+}
+
+func TestStatsD(t *testing.T) {
+	addr, read, cleanup := statsdListener(t)
+	defer cleanup()
+	s, err := NewStatsD(addr, "spotifywatcher", false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WritePoints(statsdTestPoints); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"spotifywatcher.Spotify.Spotify.cpu:12.5|g",
+		"spotifywatcher.Spotify.Spotify.pageins:4|g",
+		"spotifywatcher.Spotify.Spotify.threads:30|g",
+		"spotifywatcher.Spotify.Spotify_Helper_renderer.cpu:3.5|g",
+		"spotifywatcher.Spotify.Spotify_Helper_renderer.pageins:1|g",
+		"spotifywatcher.Spotify.Spotify_Helper_renderer.threads:22|g",
+	}
+	if lines := read(len(want)); !reflect.DeepEqual(lines, want) {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+
+	s.HandleEvent(Event{Type: EventClosing, Target: "Spotify"})
+	if lines := read(1); lines[0] != "spotifywatcher.Spotify.events.closing:1|c" {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestDogStatsD(t *testing.T) {
+	addr, read, cleanup := statsdListener(t)
+	defer cleanup()
+	s, err := NewStatsD(addr, "sw", true, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sample every other metric.
+	sampled := 0.0
+	s.sample = func() float64 {
+		sampled = 0.9 - sampled
+		return sampled
+	}
+	if err := s.WritePoints(statsdTestPoints[:2]); err != nil {
+		t.Fatal(err)
+	}
+	s.HandleEvent(Event{Type: EventKilled, Target: "Spotify"})
+	want := []string{
+		"sw.events.killed:1|c|@0.5|#target:Spotify",
+		"sw.process.threads:30|g|@0.5|#target:Spotify,host:mac,command:Spotify,pid:1,player_state:paused",
+	}
+	if lines := read(len(want)); !reflect.DeepEqual(lines, want) {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+}
+
+func TestStatsDRate(t *testing.T) {
+	for _, rate := range []float64{0, -1, 1.5} {
+		if _, err := NewStatsD("localhost:8125", "", false, rate); err == nil {
+			t.Errorf("rate %v: got no error", rate)
+		}
+	}
+}
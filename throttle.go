@@ -0,0 +1,10 @@
+package main
+
+// Throttler limits the CPU available to a process and its children, without
+// stopping them, until released.
+type Throttler interface {
+	// Throttle caps the process tree rooted at pid to the given CPU percentage.
+	Throttle(pid int, cpu float64) error
+	// Release lifts the CPU cap, returning the processes to where they were.
+	Release() error
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+func newThrottler() (Throttler, error) {
+	return nil, errors.New("CPU throttling is only supported on Linux")
+}
@@ -1,17 +1,27 @@
 package main
 
 import (
-	"bufio"
 	"os"
+	"sync/atomic"
 )
 
 type Top struct {
-	cmd     *IdleCmd
-	scanner *bufio.Scanner
-	results []Process
+	topSource // Platform specific.
+	results   []Process
 
 	// NextTick sends a Tick whenever new results are available.
 	NextTick chan Tick
+
+	parseErrors uint64
+}
+
+func (t *Top) ProcessList() []Process {
+	return t.results
+}
+
+// ParseErrors returns the number of processes that couldn't be made sense of.
+func (t *Top) ParseErrors() uint64 {
+	return atomic.LoadUint64(&t.parseErrors)
 }
 
 type Process struct {
@@ -24,6 +34,19 @@ type Process struct {
 	Pageins string
 }
 
+// inProcessTree returns whether pid is root, or one of its descendants.
+func inProcessTree(root, pid int) bool {
+	if pid == root {
+		return true
+	}
+	for _, child := range childPids(root) {
+		if pid == child {
+			return true
+		}
+	}
+	return false
+}
+
 func kill(pid int) (err error) {
 	proc, err := os.FindProcess(pid)
 	if err != nil {
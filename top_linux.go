@@ -0,0 +1,192 @@
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The name of the main Spotify process, as the kernel knows it. Helpers share
+// the name, so we tell them apart by their --type, e.g. "spotify (renderer)".
+const spotifyCommand = "spotify"
+
+// clockTicks is the unit of CPU time in /proc/[pid]/stat. It's USER_HZ, which
+// is 100 on every architecture Spotify runs on.
+const clockTicks = 100
+
+// Linux has no `top` that's nice to parse, so we read /proc ourselves, working
+// out CPU usage from the change in each process's CPU time between samples.
+type topSource struct {
+	interval time.Duration
+	prev     map[string]procStat
+	prevTime time.Time
+}
+
+func NewTop(interval int) *Top {
+	top := &Top{topSource: topSource{interval: time.Duration(interval) * time.Second}, NextTick: make(chan Tick)}
+	go top.watch()
+	return top
+}
+
+func (t *Top) watch() {
+	t.sample() // We need two samples before we know anything about CPU usage.
+	for range time.Tick(t.interval) {
+		t.results = t.sample()
+		select {
+		case t.NextTick <- Tick{}:
+		default:
+			// Don't block on notifying about next tick.
+		}
+	}
+}
+
+// procStat is what we need from /proc/[pid]/stat.
+type procStat struct {
+	Pid     string
+	Comm    string
+	State   string
+	Ppid    string
+	Majflt  int
+	Ticks   int // utime + stime
+	Threads int
+}
+
+var errBadStat = errors.New("bad /proc/[pid]/stat")
+
+// parseProcStat parses a line such as:
+// "1234 (spotify) S 1 1234 1234 0 -1 4194560 123 0 45 0 678 90 0 0 20 0 32 0 ..."
+func parseProcStat(line string) (s procStat, err error) {
+	lparen := strings.Index(line, "(")
+	rparen := strings.LastIndex(line, ")") // The command may contain ")".
+	if lparen < 0 || rparen < lparen {
+		return s, errBadStat
+	}
+	fields := strings.Fields(line[rparen+1:])
+	if len(fields) < 18 {
+		return s, errBadStat
+	}
+	// fields[0] is the 3rd field in proc(5), and so on.
+	majflt, err1 := strconv.Atoi(fields[9])
+	utime, err2 := strconv.Atoi(fields[11])
+	stime, err3 := strconv.Atoi(fields[12])
+	threads, err4 := strconv.Atoi(fields[17])
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return s, errBadStat
+	}
+	return procStat{
+		Pid:     strings.TrimSpace(line[:lparen]),
+		Comm:    line[lparen+1 : rparen],
+		State:   fields[0],
+		Ppid:    fields[1],
+		Majflt:  majflt,
+		Ticks:   utime + stime,
+		Threads: threads,
+	}, nil
+}
+
+var procStates = map[string]string{
+	"R": "running",
+	"S": "sleeping",
+	"D": "stuck",
+	"Z": "zombie",
+	"T": "stopped",
+	"t": "stopped",
+	"I": "idle",
+}
+
+// formatCpuTime formats clock ticks like `top` does, as "MM:SS.hh".
+func formatCpuTime(ticks int) string {
+	hundredths := ticks * 100 / clockTicks
+	return fmt.Sprintf("%02d:%02d.%02d", hundredths/6000, hundredths/100%60, hundredths%100)
+}
+
+// commandName returns the process name, with the --type of helper processes.
+func commandName(pid, comm string) string {
+	cmdline, err := ioutil.ReadFile(filepath.Join("/proc", pid, "cmdline"))
+	if err != nil {
+		return comm
+	}
+	for _, arg := range bytes.Split(cmdline, []byte{0}) {
+		if bytes.HasPrefix(arg, []byte("--type=")) {
+			return fmt.Sprintf("%s (%s)", comm, arg[len("--type="):])
+		}
+	}
+	return comm
+}
+
+func (t *Top) sample() (results []Process) {
+	now := time.Now()
+	elapsed := now.Sub(t.prevTime).Seconds()
+	stats := make(map[string]procStat)
+	paths, _ := filepath.Glob("/proc/[0-9]*/stat")
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue // Exited since we listed it.
+		}
+		s, err := parseProcStat(string(data))
+		if err != nil {
+			atomic.AddUint64(&t.parseErrors, 1)
+			continue
+		}
+		stats[s.Pid] = s
+		prev, ok := t.prev[s.Pid]
+		if !ok || prev.Ticks > s.Ticks {
+			continue // New process (or PID reused); wait for the next sample.
+		}
+		cpu := float64(s.Ticks-prev.Ticks) / clockTicks / elapsed * 100
+		state, ok := procStates[s.State]
+		if !ok {
+			state = s.State
+		}
+		results = append(results, Process{
+			Pid:     s.Pid,
+			Command: commandName(s.Pid, s.Comm),
+			Cpu:     strconv.FormatFloat(cpu, 'f', 1, 64),
+			Threads: strconv.Itoa(s.Threads),
+			State:   state,
+			Time:    formatCpuTime(s.Ticks),
+			Pageins: strconv.Itoa(s.Majflt),
+		})
+	}
+	t.prev, t.prevTime = stats, now
+	return results
+}
+
+// childPids returns all descendants of pid, found by walking /proc.
+func childPids(pid int) (pids []int) {
+	paths, _ := filepath.Glob("/proc/[0-9]*/stat")
+	children := make(map[int][]int)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		s, err := parseProcStat(string(data))
+		if err != nil {
+			continue
+		}
+		child, err1 := strconv.Atoi(s.Pid)
+		parent, err2 := strconv.Atoi(s.Ppid)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		children[parent] = append(children[parent], child)
+	}
+	queue := children[pid]
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		pids = append(pids, next)
+		queue = append(queue, children[next]...)
+	}
+	return
+}
@@ -0,0 +1,94 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var procStatTestTable = []struct {
+	line string
+	stat procStat
+	ok   bool
+}{
+	{
+		"1234 (spotify) S 1 1234 1234 0 -1 4194560 123 0 45 0 678 90 0 0 20 0 32 0 5555 0 0",
+		procStat{Pid: "1234", Comm: "spotify", State: "S", Ppid: "1", Majflt: 45, Ticks: 768, Threads: 32},
+		true,
+	},
+	{
+		"99 (a (weird) name) R 98 99 99 0 -1 0 0 0 7 0 10 5 0 0 20 0 1 0 100 0 0",
+		procStat{Pid: "99", Comm: "a (weird) name", State: "R", Ppid: "98", Majflt: 7, Ticks: 15, Threads: 1},
+		true,
+	},
+	{"1234 (spotify) S 1 1234", procStat{}, false},
+	{"garbage", procStat{}, false},
+}
+
+func TestParseProcStat(t *testing.T) {
+	for _, tt := range procStatTestTable {
+		s, err := parseProcStat(tt.line)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseProcStat(%q): unexpected error %v", tt.line, err)
+			continue
+		}
+		if s != tt.stat {
+			t.Errorf("parseProcStat(%q): got %+v, want %+v", tt.line, s, tt.stat)
+		}
+	}
+}
+
+func TestFormatCpuTime(t *testing.T) {
+	for ticks, want := range map[int]string{
+		0:     "00:00.00",
+		55:    "00:00.55",
+		17409: "02:54.09",
+	} {
+		if got := formatCpuTime(ticks); got != want {
+			t.Errorf("formatCpuTime(%d): got %s, want %s", ticks, got, want)
+		}
+	}
+}
+
+func TestTopSampleFindsSelf(t *testing.T) {
+	top := &Top{}
+	top.sample()
+	// Burn a little CPU, so there's something to see.
+	for start := time.Now(); time.Since(start) < 100*time.Millisecond; {
+	}
+	pid := strconv.Itoa(os.Getpid())
+	for _, p := range top.sample() {
+		if p.Pid != pid {
+			continue
+		}
+		if cpu, err := strconv.ParseFloat(p.Cpu, 64); err != nil || cpu <= 0 {
+			t.Errorf("expected some CPU usage, got %q", p.Cpu)
+		}
+		if p.State == "" || p.Threads == "" || p.Time == "" {
+			t.Errorf("incomplete process: %+v", p)
+		}
+		return
+	}
+	t.Errorf("own process %s not found", pid)
+}
+
+func TestInProcessTree(t *testing.T) {
+	sleep := exec.Command("sleep", "60")
+	if err := sleep.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sleep.Wait()
+	defer sleep.Process.Kill()
+
+	self := os.Getpid()
+	if !inProcessTree(self, self) || !inProcessTree(self, sleep.Process.Pid) {
+		t.Error("expected ourselves and our child to be in our process tree")
+	}
+	if inProcessTree(sleep.Process.Pid, self) {
+		t.Error("didn't expect our parent to be in our child's process tree")
+	}
+}
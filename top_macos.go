@@ -4,14 +4,23 @@ package main
 
 import (
 	"bufio"
-	"log"
 	"os/exec"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// The name of the main Spotify process, as `top` lists it. Helpers are named
+// "Spotify Helper", "Spotify Web Helper" and so on.
+const spotifyCommand = "Spotify"
+
+type topSource struct {
+	cmd     *IdleCmd
+	scanner *bufio.Scanner
+}
+
 func NewTop(interval int) *Top {
 	// Processes: 306 total, 2 running, 2 stuck, 302 sleeping, 1772 threads
 	// 2016/11/20 20:18:55
@@ -30,15 +39,11 @@ func NewTop(interval int) *Top {
 	// 83615  0.0  14    sleeping 03:06.73 6089+    Google Chrome He
 	// 80917  0.0  10    sleeping 00:10.14 1+       Google Chrome He
 	cmd := exec.Command("top", "-l", "0", "-s", strconv.Itoa(interval), "-stats", "pid,cpu,th,pstate,time,pageins,command")
-	top := &Top{cmd: RunIdleCmd(cmd, 400*time.Millisecond), NextTick: make(chan Tick)}
+	top := &Top{topSource: topSource{cmd: RunIdleCmd(cmd, 400*time.Millisecond)}, NextTick: make(chan Tick)}
 	go top.watch()
 	return top
 }
 
-func (t *Top) ProcessList() []Process {
-	return t.results
-}
-
 func (t *Top) watch() {
 	counter := 0
 	for {
@@ -63,7 +68,7 @@ func (t *Top) nextLine() (line string) {
 		line = t.scanner.Text()
 	}
 	if err := t.scanner.Err(); err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	return
 }
@@ -122,14 +127,47 @@ func parseTopLine(line string) (p Process) {
 func (t *Top) scanResults() (results []Process) {
 	t.chompHeader()
 	if !reflect.DeepEqual(t.nextFields(), expectedHeaders) {
-		log.Fatal("unexpected fields")
+		fatal("unexpected fields")
 	}
 	for t.scanner.Scan() {
 		entry := parseTopLine(t.scanner.Text())
+		if entry == (Process{}) {
+			atomic.AddUint64(&t.parseErrors, 1)
+			continue
+		}
 		results = append(results, entry)
 	}
 	if err := t.scanner.Err(); err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	return results
 }
+
+// childPids returns all descendants of pid, found by listing all processes.
+func childPids(pid int) (pids []int) {
+	out, err := exec.Command("ps", "-A", "-o", "pid=,ppid=").Output()
+	if err != nil {
+		return
+	}
+	children := make(map[int][]int)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		child, err1 := strconv.Atoi(fields[0])
+		parent, err2 := strconv.Atoi(fields[1])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		children[parent] = append(children[parent], child)
+	}
+	queue := children[pid]
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		pids = append(pids, next)
+		queue = append(queue, children[next]...)
+	}
+	return
+}
@@ -0,0 +1,18 @@
+// +build !darwin,!linux
+
+package main
+
+import "log"
+
+const spotifyCommand = "Spotify"
+
+type topSource struct{}
+
+func NewTop(interval int) *Top {
+	log.Fatal("Watching processes is only supported on macOS and Linux")
+	return nil
+}
+
+func childPids(pid int) []int {
+	return nil
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type tracker struct {
+	// mu guards the tracker against commands that come in between ticks.
+	mu sync.Mutex
+
+	player    Player
+	poller    *StatePoller
+	avgCpu    *FloatWindow
+	breaches  int
+	closing   bool
+	throttler Throttler
+	throttled bool
+	last      decision
+
+	// state is the last state we saw Spotify in, since the given time.
+	state         State
+	stateSince    time.Time
+	warnedUnknown bool
+
+	// misbehaving is set from the first breach, until the median recovers.
+	misbehaving bool
+	handlers    []EventHandler
+
+	// limiter stops us acting on Spotify too often. We give up once it's hit.
+	limiter *InterventionLimiter
+	gaveUp  bool
+
+	// freezer freezes Spotify once it's been paused too long. We thaw it when
+	// its window comes to the front, which we ask the windows, as it can't say.
+	freezer Freezer
+	frozen  bool
+	windows ActiveWindow
+}
+
+// decision is the context in which the tracker last decided what to do.
+type decision struct {
+	Command string
+	Pid     string
+	State   State
+	Cpu     float64
+	Median  float64
+	Samples int
+	Track   Track
+}
+
+func (t *tracker) context() string {
+	d := t.last
+	return fmt.Sprintf("pid: %s, state: %s, CPU: %.2f (%.2f median, samples: %d), breaches: %d/%d, threshold: %.2f, playing: %s",
+		d.Pid, d.State, d.Cpu, d.Median, d.Samples, t.breaches, t.allowedBreaches(), opts.CpuThreshold, d.Track)
+}
+
+func newTracker(player Player) *tracker {
+	return &tracker{
+		player: player,
+		poller: NewStatePoller(player, playerTimeout()),
+		avgCpu: NewFloatWindow(opts.WindowLength),
+	}
+}
+
+func playerTimeout() time.Duration {
+	return time.Duration(opts.PlayerWait) * time.Second
+}
+
+// staleStateTicks is how many ticks may pass without getting Spotify's state,
+// before we stop trusting the last one we got.
+const staleStateTicks = 3
+
+// unknownStateWarning is how long Spotify's state may be unknown for, before we
+// warn about it.
+const unknownStateWarning = time.Minute
+
+// What to make of Spotify when we don't know its state, per --unknown-state.
+const (
+	unknownAsForeground = "foreground"
+	unknownAsBackground = "background"
+	unknownSkipped      = "skip"
+)
+
+// throttleRecovery is the fraction of the threshold that the median must drop
+// below before a throttled Spotify is released. Throttled, it can't exceed the
+// threshold, so we wait until it stops pushing up against its quota.
+const throttleRecovery = 0.5
+
+// userAway returns whether the user has been idle for too long (or locked the
+// screen) to be using Spotify, if we're watching for that.
+func (t *tracker) userAway() bool {
+	if opts.IdleAfter <= 0 {
+		return false
+	}
+	idle, locked := t.poller.Idle()
+	return locked || idle >= time.Duration(opts.IdleAfter)*time.Minute
+}
+
+// allowedBreaches returns how many intervals over the threshold we put up with.
+// With nobody around to mind, we don't wait at all.
+func (t *tracker) allowedBreaches() int {
+	if t.userAway() {
+		return 0
+	}
+	return opts.AllowedBreaches
+}
+
+// noteState records when Spotify changes state.
+func (t *tracker) noteState(s State) {
+	if s != t.state || t.stateSince.IsZero() {
+		t.state, t.stateSince = s, time.Now()
+		t.warnedUnknown = false
+	}
+}
+
+// warnUnknown warns, once, when we've gone too long without knowing Spotify's
+// state.
+func (t *tracker) warnUnknown() {
+	unknown := time.Since(t.stateSince)
+	if t.state != StateUnknown || t.warnedUnknown || unknown < unknownStateWarning {
+		return
+	}
+	_, _, err := t.poller.State()
+	log.Printf("Warning: Spotify's state has been unknown for %s, with %d failed polls (last error: %v). Treating it as %s.\n",
+		unknown.Round(time.Second), t.poller.Errors(), err, opts.UnknownState)
+	t.warnedUnknown = true
+}
+
+// pausedFor returns whether Spotify has sat paused (or stopped) in the
+// background for at least mins. Zero mins is never.
+func (t *tracker) pausedFor(mins int) bool {
+	if mins <= 0 || (t.state != StatePaused && t.state != StateStopped) {
+		return false
+	}
+	return time.Since(t.stateSince) >= time.Duration(mins)*time.Minute
+}
+
+// inForeground returns whether Spotify's window is the active one, asking the
+// windows rather than Spotify.
+func (t *tracker) inForeground(pid string) bool {
+	root, err := strconv.Atoi(pid)
+	if t.windows == nil || err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), playerTimeout())
+	defer cancel()
+	active, err := t.windows.Pid(ctx)
+	return err == nil && inProcessTree(root, active)
+}
+
+// emit notifies all handlers of an event, in the context of the last decision.
+func (t *tracker) emit(typ EventType) {
+	d := t.last
+	e := Event{
+		Type:      typ,
+		Time:      time.Now(),
+		Target:    d.Command,
+		Pid:       d.Pid,
+		State:     d.State,
+		Cpu:       d.Cpu,
+		Median:    d.Median,
+		Samples:   d.Samples,
+		Breaches:  t.breaches,
+		Threshold: opts.CpuThreshold,
+		DryRun:    opts.DryRun,
+		Track:     d.Track,
+	}
+	for _, h := range t.handlers {
+		h.HandleEvent(e)
+	}
+}
+
+// breach counts another interval over the threshold, noting when Spotify first
+// starts misbehaving.
+func (t *tracker) breach() {
+	t.breaches += 1
+	if !t.misbehaving {
+		t.misbehaving = true
+		t.emit(EventMisbehaving)
+	}
+}
+
+// intervene returns whether we may act on Spotify. If we've acted too often
+// already, we give up instead. Only once the action's taken is it counted, by
+// acted.
+func (t *tracker) intervene() bool {
+	if t.limiter == nil {
+		return true
+	}
+	target, now := t.last.Command, time.Now()
+	if t.limiter.Allow(target, now) {
+		t.gaveUp = false
+		return true
+	}
+	if !t.gaveUp {
+		log.Printf("Spotify keeps misbehaving, %d actions in the last %d mins. Giving up.\n",
+			t.limiter.Count(target, now), opts.ActionWindow)
+		t.gaveUp = true
+		t.emit(EventGivingUp)
+		if opts.Lockout && !t.limiter.LockedOut(target) {
+			log.Println("Spotify will be kept closed, until reset.")
+			if err := t.limiter.LockOut(target); err != nil {
+				log.Println("Failed to save action history:", err)
+			}
+		}
+	}
+	return false
+}
+
+// acted records that we've acted on Spotify, against the limit.
+func (t *tracker) acted() {
+	if t.limiter == nil {
+		return
+	}
+	if err := t.limiter.Record(t.last.Command, time.Now()); err != nil {
+		log.Println("Failed to save action history:", err)
+	}
+}
+
+// quit tells Spotify to quit, or pretends to.
+func (t *tracker) quit() error {
+	if opts.DryRun {
+		log.Printf("Dry run: would quit Spotify (%s)\n", t.context())
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), playerTimeout())
+	defer cancel()
+	err := t.player.Quit(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		// It may be too busy closing to answer. Either way it's been told, so
+		// we wait for it, as though it had answered.
+		log.Println("Spotify was slow to answer being told to quit:", err)
+		return nil
+	}
+	return err
+}
+
+func (t *tracker) reset() {
+	t.avgCpu.Reset()
+	t.breaches = 0
+	t.closing = false
+	t.misbehaving = false
+}
+
+// QuitPausedSpotify quits Spotify because it's been paused for so long, whatever
+// its CPU.
+func (t *tracker) QuitPausedSpotify() error {
+	if !t.intervene() {
+		return nil
+	}
+	log.Printf("Spotify has been %s for %s. Closing it.\n", t.state, time.Since(t.stateSince).Round(time.Minute))
+	t.closing = true
+	t.emit(EventClosing)
+	if err := t.quit(); err != nil {
+		log.Println("Failed to quit Spotify:", err)
+		// Try again once it's been paused as long again.
+		t.closing = false
+		t.stateSince = time.Now()
+		return nil
+	}
+	t.acted()
+	if opts.DryRun {
+		// Carry on as though it quit, and a fresh Spotify took its place.
+		t.reset()
+		t.state, t.stateSince = "", time.Time{}
+	}
+	return nil
+}
+
+// FreezeSpotify freezes Spotify because it's been paused for so long, so that it
+// uses nothing at all, but can carry on as soon as it's wanted.
+func (t *tracker) FreezeSpotify(p Process) error {
+	pid, err := strconv.Atoi(p.Pid)
+	if err != nil {
+		return err
+	}
+	if t.throttled {
+		// Frozen is as throttled as it gets.
+		if err := t.ReleaseSpotify(); err != nil {
+			log.Println(err)
+		}
+	}
+	log.Printf("Spotify has been %s for %s. Freezing it.\n", t.state, time.Since(t.stateSince).Round(time.Minute))
+	if opts.DryRun {
+		log.Printf("Dry run: would freeze PID %d (%s)\n", pid, t.context())
+		t.emit(EventFrozen)
+		// Carry on as though it was frozen, and thawed again, so it's paused
+		// from now.
+		t.state, t.stateSince = "", time.Time{}
+		return nil
+	}
+	if err := t.freezer.Freeze(pid); err != nil {
+		log.Println("Failed to freeze Spotify:", err)
+		t.freezer.Thaw() // Undo whatever of it worked.
+		// Try again once it's been paused as long again.
+		t.stateSince = time.Now()
+		return nil
+	}
+	t.frozen = true
+	t.poller.Pause() // It can't answer, frozen.
+	t.emit(EventFrozen)
+	return nil
+}
+
+// thaw lets a frozen Spotify carry on. If it can't be thawed, it's still frozen.
+func (t *tracker) thaw() error {
+	log.Println("Thawing Spotify.")
+	if err := t.freezer.Thaw(); err != nil {
+		return fmt.Errorf("failed to thaw Spotify: %v", err)
+	}
+	t.frozen = false
+	t.poller.Resume()
+	// It's been paused all along; start timing that afresh.
+	t.state, t.stateSince = "", time.Time{}
+	t.emit(EventThawed)
+	return nil
+}
+
+// Thaw lets Spotify carry on, if it's frozen.
+func (t *tracker) Thaw() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.frozen {
+		return nil
+	}
+	return t.thaw()
+}
+
+// Play thaws Spotify, if it's frozen, and tells it to play.
+func (t *tracker) Play() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.frozen {
+		if err := t.thaw(); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), playerTimeout())
+	defer cancel()
+	return t.player.Play(ctx)
+}
+
+func (t *tracker) CloseSpotify() error {
+	// We've told Spotify to close itself. Wait for it a bit, before erroring.
+	if t.closing {
+		if t.breaches < t.allowedBreaches()+5 {
+			log.Println("Spotify is trying to close itself...")
+			t.breach()
+			return nil
+		}
+		return fmt.Errorf("Spotify failed to close, must be forcibly killed")
+	}
+	// Spotify hasn't been told to close, but it's now misbehaving.
+	if t.breaches < t.allowedBreaches() {
+		log.Println("Spotify is misbehaving!")
+		t.breach()
+		return nil
+	}
+	if !t.intervene() {
+		return nil
+	}
+	log.Println("Okay, that's enough now. Closing Spotify.")
+	t.closing = true
+	t.emit(EventClosing)
+	if err := t.quit(); err != nil {
+		// It wasn't told, so it's not closing; it must be killed instead.
+		log.Println("Failed to quit Spotify:", err)
+		t.closing = false
+		return err
+	}
+	t.acted()
+	return nil
+}
+
+func (t *tracker) ThrottleSpotify(p Process) error {
+	if t.breaches < t.allowedBreaches() {
+		log.Println("Spotify is misbehaving!")
+		t.breach()
+		return nil
+	}
+	pid, err := strconv.Atoi(p.Pid)
+	if err != nil {
+		return err
+	}
+	if !t.intervene() {
+		return nil
+	}
+	log.Printf("Okay, that's enough now. Throttling Spotify to %.2f CPU.\n", opts.CpuThreshold)
+	if opts.DryRun {
+		log.Printf("Dry run: would throttle PID %d (%s)\n", pid, t.context())
+	} else if err := t.throttler.Throttle(pid, opts.CpuThreshold); err != nil {
+		log.Println("Failed to throttle Spotify:", err)
+		return nil
+	}
+	t.acted()
+	t.avgCpu.Reset() // Start afresh, so we only judge how it behaves while throttled.
+	t.throttled = true
+	t.emit(EventThrottled)
+	return nil
+}
+
+// ReleaseSpotify lifts Spotify's CPU limit. If it can't be lifted, it's still
+// throttled, so we try again next time.
+func (t *tracker) ReleaseSpotify() error {
+	log.Println("Spotify has calmed down. Releasing its CPU limit.")
+	if opts.DryRun {
+		log.Printf("Dry run: would release PID %s (%s)\n", t.last.Pid, t.context())
+	} else if err := t.throttler.Release(); err != nil {
+		return fmt.Errorf("failed to release Spotify's CPU limit: %v", err)
+	}
+	t.throttled = false
+	t.breaches = 0
+	t.misbehaving = false
+	t.emit(EventReleased)
+	return nil
+}
+
+// Shutdown leaves Spotify as we found it, before we exit.
+func (t *tracker) Shutdown() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.frozen {
+		if err := t.thaw(); err != nil {
+			log.Println(err)
+		}
+	}
+	if t.throttled && !opts.DryRun {
+		log.Println("Releasing Spotify's CPU limit, before exiting.")
+		if err := t.throttler.Release(); err != nil {
+			log.Println("Failed to release Spotify's CPU limit:", err)
+		}
+		t.throttled = false
+	}
+}
+
+// Kill kills Spotify, because it failed to close, or couldn't be told to. Only
+// in the latter case is it counted against the limit, the quit being counted
+// already.
+func (t *tracker) Kill(p Process) error {
+	pid, err := strconv.Atoi(p.Pid)
+	if err != nil {
+		return err
+	}
+	if opts.DryRun {
+		log.Printf("Dry run: would kill PID %d (%s)\n", pid, t.context())
+	} else {
+		log.Printf("Killing the Spotify process! (%s)\n", t.context())
+		if err := kill(pid); err != nil {
+			return err
+		}
+	}
+	if !t.closing {
+		t.acted()
+	}
+	t.emit(EventKilled)
+	if opts.DryRun {
+		// Carry on as though it was killed, and a fresh Spotify took its place.
+		t.reset()
+	}
+	return nil
+}
+
+func (t *tracker) spotifyState() State {
+	if t.closing {
+		return StateClosing
+	} else {
+		state, age, _ := t.poller.State()
+		if age > staleStateTicks*time.Duration(opts.TopInterval)*time.Second {
+			return StateUnknown
+		}
+		return state
+	}
+}
+
+// Metrics returns the tracker's view of Spotify, as of its last decision: what
+// it made of it, and what it had to go on.
+func (t *tracker) Metrics() (metricTags, metricFields) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.last
+	state := string(d.State)
+	if d.Pid == "" {
+		state = string(StateClosed)
+	} else if d.State == StateUnknown {
+		state = "unknown"
+	}
+	return metricTags{"player_state": state}, metricFields{
+		"cpu":              d.Cpu,
+		"median":           d.Median,
+		"samples":          d.Samples,
+		"breaches":         t.breaches,
+		"allowed_breaches": t.allowedBreaches(),
+		"threshold":        opts.CpuThreshold,
+		"misbehaving":      t.misbehaving,
+		"closing":          t.closing,
+		"throttled":        t.throttled,
+		"frozen":           t.frozen,
+		"state_errors":     int64(t.poller.Errors()),
+	}
+}
+
+// Observe takes a tick's sample of the Spotify process, or an empty Process if
+// it isn't running, and decides what to do about it.
+func (t *tracker) Observe(p Process) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.observe(p)
+}
+
+func (t *tracker) observe(p Process) (err error) {
+	if p == (Process{}) {
+		// Nil process means no Spotify, so reset all counters and return.
+		if t.last.Pid != "" {
+			t.emit(EventExited)
+		}
+		if t.throttled {
+			err = t.ReleaseSpotify()
+		}
+		if t.frozen {
+			if err := t.thaw(); err != nil {
+				// It's gone, so there's nothing left to thaw but the group it
+				// was in.
+				log.Println(err)
+				t.frozen = false
+				t.poller.Resume()
+			}
+		}
+		t.reset()
+		t.last = decision{}
+		t.state, t.stateSince = "", time.Time{}
+		return
+	}
+	cpu, err := strconv.ParseFloat(p.Cpu, 64)
+	if err != nil {
+		return err
+	}
+	// Frozen, it's doing nothing, until it's wanted again.
+	if t.frozen {
+		if t.inForeground(p.Pid) {
+			if err := t.thaw(); err != nil {
+				log.Println(err)
+			}
+		}
+		return nil
+	}
+	// We gave up on Spotify, and it's locked out; keep it closed.
+	if t.limiter != nil && t.limiter.LockedOut(p.Command) {
+		if t.closing {
+			return nil
+		}
+		log.Println("Spotify is locked out. Closing it.")
+		t.closing = true
+		t.last = decision{Command: p.Command, Pid: p.Pid, State: StateClosing, Cpu: cpu, Track: t.poller.Track()}
+		t.emit(EventClosing)
+		if err := t.quit(); err != nil {
+			log.Println("Failed to quit Spotify:", err)
+			t.closing = false // Try again next tick.
+		} else if opts.DryRun {
+			// Carry on as though it quit, and a fresh Spotify took its place.
+			t.reset()
+		}
+		return nil
+	}
+	// Check state: foreground, background (playing/paused/etc).
+	state := t.spotifyState()
+	t.noteState(state)
+	if state == StateUnknown {
+		t.warnUnknown()
+		if opts.UnknownState == unknownSkipped {
+			if !opts.Quiet {
+				log.Printf("Spotify: %s (skipped), CPU: %.2f\n", state, cpu)
+			}
+			return nil
+		}
+	}
+	// Active in the foreground (or may be); ignore, unless forceful, or nobody's
+	// using it.
+	foreground := state == StateForeground || (state == StateUnknown && opts.UnknownState == unknownAsForeground)
+	if foreground && !opts.Force && !t.userAway() {
+		t.last = decision{Command: p.Command, Pid: p.Pid, State: state, Cpu: cpu, Track: t.poller.Track()}
+		if !opts.Quiet {
+			log.Printf("Spotify: %s (ignored), CPU: %.2f\n", state, cpu)
+		}
+		if t.throttled {
+			// We're using it now, so let it have what it needs.
+			return t.ReleaseSpotify()
+		}
+		return nil
+	}
+
+	t.avgCpu.Append(cpu)
+	samples := t.avgCpu.Len()
+	median := t.avgCpu.Median()
+	t.last = decision{Command: p.Command, Pid: p.Pid, State: state, Cpu: cpu, Median: median, Samples: samples, Track: t.poller.Track()}
+	if !opts.Quiet {
+		log.Printf("Spotify: %s, CPU: %.2f (%.2f median, samples: %d)\n", state, cpu, median, samples)
+	}
+	if t.freezer != nil && t.pausedFor(opts.FreezePaused) {
+		return t.FreezeSpotify(p)
+	}
+	if t.pausedFor(opts.QuitPaused) {
+		return t.QuitPausedSpotify()
+	}
+
+	// Take action if we have sufficient samples.
+	if t.throttled {
+		if samples == opts.WindowLength && median < opts.CpuThreshold*throttleRecovery {
+			return t.ReleaseSpotify()
+		}
+		return nil
+	}
+	if t.misbehaving && samples == opts.WindowLength && median <= opts.CpuThreshold {
+		log.Println("Spotify has recovered.")
+		t.misbehaving = false
+		t.emit(EventRecovered)
+	}
+	if samples == opts.WindowLength && median > opts.CpuThreshold {
+		if t.throttler != nil {
+			return t.ThrottleSpotify(p)
+		}
+		if err := t.CloseSpotify(); err != nil {
+			return t.Kill(p)
+		}
+	}
+	return nil
+}
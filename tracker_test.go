@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakePlayer is a Player scripted with the states it reports, one per call to
+// State, repeating the last. It records the commands it's given.
+type fakePlayer struct {
+	states []State
+	track  Track
+	calls  []string
+	hang   bool  // Quit waits until it's given up on.
+	quit   error // Returned from Quit.
+}
+
+func (f *fakePlayer) State(ctx context.Context) (State, error) {
+	s := f.states[0]
+	if len(f.states) > 1 {
+		f.states = f.states[1:]
+	}
+	return s, nil
+}
+
+func (f *fakePlayer) Quit(ctx context.Context) error {
+	f.calls = append(f.calls, "quit")
+	if f.hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return f.quit
+}
+
+func (f *fakePlayer) Pause(ctx context.Context) error {
+	f.calls = append(f.calls, "pause")
+	return nil
+}
+
+func (f *fakePlayer) Play(ctx context.Context) error {
+	f.calls = append(f.calls, "play")
+	return nil
+}
+
+func (f *fakePlayer) NowPlaying(ctx context.Context) (Track, error) {
+	return f.track, nil
+}
+
+// activeWindow is an ActiveWindow owned by a fixed process.
+type activeWindow int
+
+func (w activeWindow) Pid(ctx context.Context) (int, error) {
+	return int(w), nil
+}
+
+// eventRecorder keeps all the events it handles.
+type eventRecorder []Event
+
+func (r *eventRecorder) HandleEvent(e Event) {
+	*r = append(*r, e)
+}
+
+func (r eventRecorder) types() (types []EventType) {
+	for _, e := range r {
+		types = append(types, e.Type)
+	}
+	return
+}
+
+// withOptions sets the global options for the duration of a test.
+func withOptions(o options) (restore func()) {
+	saved := opts
+	opts = o
+	return func() { opts = saved }
+}
+
+var trackerTestOptions = options{
+	TopInterval:     4,
+	PlayerWait:      1,
+	UnknownState:    unknownAsBackground,
+	CpuThreshold:    8.0,
+	WindowLength:    3,
+	AllowedBreaches: 2,
+	Quiet:           true,
+}
+
+func newTestTracker(states ...State) (*tracker, *fakePlayer, *eventRecorder) {
+	player := &fakePlayer{states: states}
+	events := &eventRecorder{}
+	t := newTracker(player)
+	t.handlers = append(t.handlers, events)
+	return t, player, events
+}
+
+func observeCpu(t *testing.T, tr *tracker, p Process, cpus ...float64) {
+	for _, cpu := range cpus {
+		p.Cpu = strconv.FormatFloat(cpu, 'f', 1, 64)
+		tr.poller.Poll()
+		if err := tr.Observe(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTrackerIgnoresForeground(t *testing.T) {
+	defer withOptions(trackerTestOptions)()
+	tr, player, events := newTestTracker(StateForeground)
+
+	observeCpu(t, tr, Process{Pid: "1", Command: "Spotify"}, 50, 50, 50, 50, 50, 50, 50, 50)
+	if len(*events) != 0 || len(player.calls) != 0 {
+		t.Errorf("foreground Spotify should be ignored, got events %v, calls %v", events.types(), player.calls)
+	}
+}
+
+func TestTrackerQuitsThenKills(t *testing.T) {
+	defer withOptions(trackerTestOptions)()
+	tr, player, events := newTestTracker(StatePlaying)
+
+	// Stand in for Spotify with something we can safely kill.
+	sleep := exec.Command("sleep", "60")
+	if err := sleep.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sleep.Process.Kill()
+	p := Process{Pid: strconv.Itoa(sleep.Process.Pid), Command: "Spotify"}
+
+	// Two ticks to fill the window, two breaches allowed, then we quit.
+	observeCpu(t, tr, p, 20, 20, 20, 20, 20)
+	if !reflect.DeepEqual(player.calls, []string{"quit"}) {
+		t.Fatalf("expected Spotify to be told to quit, got %v", player.calls)
+	}
+	// It ignores us, so after five more breaches it's killed.
+	observeCpu(t, tr, p, 20, 20, 20, 20, 20, 20)
+	want := []EventType{EventMisbehaving, EventClosing, EventKilled}
+	if !reflect.DeepEqual(events.types(), want) {
+		t.Errorf("got events %v, want %v", events.types(), want)
+	}
+	if err := sleep.Wait(); err == nil {
+		t.Error("process should have been killed")
+	}
+	killed := (*events)[2]
+	if killed.State != StateClosing || killed.Breaches != 7 || killed.Median != 20 {
+		t.Errorf("unexpected context for kill: %+v", killed)
+	}
+}
+
+func TestTrackerWaitsOnSlowQuit(t *testing.T) {
+	defer withOptions(trackerTestOptions)()
+	tr, player, events := newTestTracker(StatePlaying)
+	player.hang = true
+	p := Process{Pid: "1", Command: "Spotify"}
+
+	// Told to quit, Spotify doesn't answer in time, but may still be closing.
+	observeCpu(t, tr, p, 20, 20, 20, 20, 20)
+	if !reflect.DeepEqual(player.calls, []string{"quit"}) {
+		t.Fatalf("expected Spotify to be told to quit, got %v", player.calls)
+	}
+	observeCpu(t, tr, p, 20)
+	want := []EventType{EventMisbehaving, EventClosing}
+	if !reflect.DeepEqual(events.types(), want) {
+		t.Errorf("got events %v, want %v", events.types(), want)
+	}
+	if !tr.closing {
+		t.Error("Spotify should still be closing")
+	}
+}
+
+func TestTrackerDryRun(t *testing.T) {
+	o := trackerTestOptions
+	o.DryRun = true
+	defer withOptions(o)()
+	tr, player, events := newTestTracker(StatePaused)
+	player.track = Track{Name: "Windowlicker", Artist: "Aphex Twin", URI: "spotify:track:5qMZ8wBOPvOUVVmr2JGbmG"}
+
+	observeCpu(t, tr, Process{Pid: "999999", Command: "Spotify"}, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20)
+	if len(player.calls) != 0 {
+		t.Errorf("dry run shouldn't touch the player, got %v", player.calls)
+	}
+	want := []EventType{EventMisbehaving, EventClosing, EventKilled}
+	if !reflect.DeepEqual(events.types(), want) {
+		t.Errorf("got events %v, want %v", events.types(), want)
+	}
+	for _, e := range *events {
+		if !e.DryRun {
+			t.Errorf("%s event should be marked as a dry run", e.Type)
+		}
+		if e.Track != player.track {
+			t.Errorf("%s event: got track %s, want %s", e.Type, e.Track, player.track)
+		}
+	}
+}
+
+func TestTrackerRecoversAndExits(t *testing.T) {
+	defer withOptions(trackerTestOptions)()
+	tr, player, events := newTestTracker(StatePlaying)
+
+	p := Process{Pid: "1", Command: "Spotify"}
+	observeCpu(t, tr, p, 20, 20, 20, 1, 1, 1)
+	if err := tr.Observe(Process{}); err != nil {
+		t.Fatal(err)
+	}
+	want := []EventType{EventMisbehaving, EventRecovered, EventExited}
+	if !reflect.DeepEqual(events.types(), want) {
+		t.Errorf("got events %v, want %v", events.types(), want)
+	}
+	if len(player.calls) != 0 {
+		t.Errorf("expected no player commands, got %v", player.calls)
+	}
+}
+
+func TestTrackerQuitsPausedSpotify(t *testing.T) {
+	o := trackerTestOptions
+	o.QuitPaused = 30
+	defer withOptions(o)()
+	p := Process{Pid: "1", Command: "Spotify"}
+
+	for _, tt := range []struct {
+		state State
+		quit  bool
+	}{
+		{StatePaused, true},
+		{StateStopped, true},
+		{StatePlaying, false},
+		{StateForeground, false},
+	} {
+		tr, player, events := newTestTracker(tt.state)
+		observeCpu(t, tr, p, 1, 1)
+		if len(player.calls) != 0 {
+			t.Fatalf("%s: quit too soon, got %v", tt.state, player.calls)
+		}
+		tr.stateSince = tr.stateSince.Add(-31 * time.Minute)
+		observeCpu(t, tr, p, 1)
+		if quit := reflect.DeepEqual(player.calls, []string{"quit"}); quit != tt.quit {
+			t.Errorf("%s for 31 mins: got calls %v, events %v", tt.state, player.calls, events.types())
+		}
+	}
+}
+
+func TestTrackerCarriesOnAfterQuittingPausedSpotify(t *testing.T) {
+	o := trackerTestOptions
+	o.QuitPaused = 30
+	defer withOptions(o)()
+	p := Process{Pid: "1", Command: "Spotify"}
+
+	for _, tt := range []struct {
+		name   string
+		dryRun bool
+		err    error
+	}{
+		{"dry run", true, nil},
+		{"failed", false, errors.New("no reply")},
+	} {
+		opts.DryRun = tt.dryRun
+		tr, player, events := newTestTracker(StatePaused)
+		player.quit = tt.err
+		observeCpu(t, tr, p, 1)
+		tr.stateSince = tr.stateSince.Add(-31 * time.Minute)
+		observeCpu(t, tr, p, 1)
+		if !reflect.DeepEqual(events.types(), []EventType{EventClosing}) {
+			t.Errorf("%s: got events %v, want %v", tt.name, events.types(), []EventType{EventClosing})
+		}
+		// Not closing, it's paused again from now, and not quit again yet.
+		observeCpu(t, tr, p, 1)
+		if tr.closing || time.Since(tr.stateSince) > time.Minute || len(*events) != 1 {
+			t.Errorf("%s: closing %t, paused for %s, events %v", tt.name, tr.closing, time.Since(tr.stateSince), events.types())
+		}
+	}
+}
+
+func TestTrackerOnlyCountsActionsTaken(t *testing.T) {
+	o := trackerTestOptions
+	o.QuitPaused = 30
+	defer withOptions(o)()
+	tr, player, events := newTestTracker(StatePaused)
+	tr.limiter = &InterventionLimiter{max: 1, window: time.Hour, targets: make(map[string]*interventionHistory)}
+	player.quit = errors.New("no reply")
+	p := Process{Pid: "1", Command: "Spotify"}
+
+	// Failing to quit it, again and again, doesn't use up what we're allowed.
+	for i := 0; i < 3; i++ {
+		observeCpu(t, tr, p, 1)
+		tr.stateSince = tr.stateSince.Add(-31 * time.Minute)
+		observeCpu(t, tr, p, 1)
+	}
+	if n := tr.limiter.Count("Spotify", time.Now()); n != 0 || tr.gaveUp {
+		t.Fatalf("got %d actions counted, gave up %t, after failing to quit", n, tr.gaveUp)
+	}
+	player.quit = nil
+	tr.stateSince = tr.stateSince.Add(-31 * time.Minute)
+	observeCpu(t, tr, p, 1)
+	if n := tr.limiter.Count("Spotify", time.Now()); n != 1 {
+		t.Errorf("got %d actions counted, want 1 for the quit", n)
+	}
+	want := []EventType{EventClosing, EventClosing, EventClosing, EventClosing}
+	if !reflect.DeepEqual(events.types(), want) || len(player.calls) != 4 {
+		t.Errorf("got events %v, calls %v, want %v", events.types(), player.calls, want)
+	}
+}
+
+// fakeFreezer records what it's asked to freeze and thaw.
+type fakeFreezer struct {
+	calls []string
+	err   error // Returned from Freeze.
+}
+
+func (f *fakeFreezer) Freeze(pid int) error {
+	f.calls = append(f.calls, "freeze "+strconv.Itoa(pid))
+	return f.err
+}
+
+func (f *fakeFreezer) Thaw() error {
+	f.calls = append(f.calls, "thaw")
+	return nil
+}
+
+// fakeThrottler records what it's asked to throttle and release.
+type fakeThrottler struct {
+	calls   []string
+	release error // Returned from Release.
+}
+
+func (f *fakeThrottler) Throttle(pid int, cpu float64) error {
+	f.calls = append(f.calls, "throttle "+strconv.Itoa(pid))
+	return nil
+}
+
+func (f *fakeThrottler) Release() error {
+	f.calls = append(f.calls, "release")
+	return f.release
+}
+
+func TestTrackerRetriesRelease(t *testing.T) {
+	defer withOptions(trackerTestOptions)()
+	tr, _, events := newTestTracker(StatePlaying)
+	throttler := &fakeThrottler{release: errors.New("device busy")}
+	tr.throttler = throttler
+	p := Process{Pid: "42", Command: "Spotify"}
+
+	observeCpu(t, tr, p, 20, 20, 20, 20, 20)
+	if !tr.throttled || !reflect.DeepEqual(throttler.calls, []string{"throttle 42"}) {
+		t.Fatalf("throttled %t, throttler %v", tr.throttled, throttler.calls)
+	}
+	// It calms down, but can't be released, so it's still throttled.
+	observeCpu(t, tr, p, 1, 1)
+	p.Cpu = "1.0"
+	tr.poller.Poll()
+	if err := tr.Observe(p); err == nil {
+		t.Error("expected the release to fail")
+	}
+	if !tr.throttled || events.types()[len(*events)-1] != EventThrottled {
+		t.Fatalf("throttled %t, events %v, want still throttled", tr.throttled, events.types())
+	}
+	// Next time, it's released.
+	throttler.release = nil
+	observeCpu(t, tr, p, 1)
+	want := []EventType{EventMisbehaving, EventThrottled, EventReleased}
+	if tr.throttled || !reflect.DeepEqual(events.types(), want) {
+		t.Errorf("throttled %t, got events %v, want %v", tr.throttled, events.types(), want)
+	}
+	if want := []string{"throttle 42", "release", "release"}; !reflect.DeepEqual(throttler.calls, want) {
+		t.Errorf("got throttler calls %v, want %v", throttler.calls, want)
+	}
+}
+
+func TestTrackerKeepsLockedOutSpotifyClosed(t *testing.T) {
+	defer withOptions(trackerTestOptions)()
+	tr, player, events := newTestTracker(StatePlaying)
+	tr.limiter = &InterventionLimiter{max: 1, window: time.Hour, targets: make(map[string]*interventionHistory)}
+	tr.limiter.LockOut("Spotify")
+	player.quit = errors.New("no reply")
+	p := Process{Pid: "1", Command: "Spotify"}
+
+	// It fails to quit, so we try again the next tick.
+	observeCpu(t, tr, p, 1, 1)
+	if !reflect.DeepEqual(player.calls, []string{"quit", "quit"}) || tr.closing {
+		t.Errorf("got calls %v, closing %t", player.calls, tr.closing)
+	}
+	want := []EventType{EventClosing, EventClosing}
+	if !reflect.DeepEqual(events.types(), want) {
+		t.Errorf("got events %v, want %v", events.types(), want)
+	}
+}
+
+func TestTrackerFreezesPausedSpotify(t *testing.T) {
+	o := trackerTestOptions
+	o.FreezePaused = 30
+	o.QuitPaused = 60
+	defer withOptions(o)()
+	tr, player, events := newTestTracker(StatePaused)
+	freezer := &fakeFreezer{}
+	window := activeWindow(1)
+	tr.freezer, tr.windows = freezer, &window
+	p := Process{Pid: "42", Command: "Spotify"}
+
+	observeCpu(t, tr, p, 1)
+	tr.stateSince = tr.stateSince.Add(-31 * time.Minute)
+	observeCpu(t, tr, p, 1, 0, 0)
+	if !reflect.DeepEqual(freezer.calls, []string{"freeze 42"}) || len(player.calls) != 0 {
+		t.Fatalf("expected Spotify to be frozen, got %v, player %v", freezer.calls, player.calls)
+	}
+
+	// Brought to the front, it's thawed, and not frozen again for a while.
+	window = activeWindow(42)
+	observeCpu(t, tr, p, 0, 1, 1)
+	want := []EventType{EventFrozen, EventThawed}
+	if !reflect.DeepEqual(events.types(), want) || !reflect.DeepEqual(freezer.calls, []string{"freeze 42", "thaw"}) {
+		t.Errorf("got events %v, freezer %v, want %v", events.types(), freezer.calls, want)
+	}
+}
+
+func TestTrackerFailsToFreeze(t *testing.T) {
+	o := trackerTestOptions
+	o.FreezePaused = 30
+	defer withOptions(o)()
+	tr, _, events := newTestTracker(StatePaused)
+	freezer := &fakeFreezer{err: errors.New("permission denied")}
+	tr.freezer = freezer
+	p := Process{Pid: "42", Command: "Spotify"}
+
+	observeCpu(t, tr, p, 1)
+	tr.stateSince = tr.stateSince.Add(-31 * time.Minute)
+	observeCpu(t, tr, p, 1, 1)
+	// Undone, and not tried again until it's been paused as long again.
+	if tr.frozen || len(*events) != 0 || !reflect.DeepEqual(freezer.calls, []string{"freeze 42", "thaw"}) {
+		t.Errorf("frozen %t, events %v, freezer %v", tr.frozen, events.types(), freezer.calls)
+	}
+}
+
+func TestTrackerDryRunFreeze(t *testing.T) {
+	o := trackerTestOptions
+	o.FreezePaused = 30
+	o.DryRun = true
+	defer withOptions(o)()
+	tr, _, events := newTestTracker(StatePaused)
+	freezer := &fakeFreezer{}
+	tr.freezer = freezer // With no windows to say when it comes to the front.
+	p := Process{Pid: "42", Command: "Spotify"}
+
+	observeCpu(t, tr, p, 1)
+	tr.stateSince = tr.stateSince.Add(-31 * time.Minute)
+	observeCpu(t, tr, p, 1)
+	if tr.frozen || tr.poller.paused || len(freezer.calls) != 0 {
+		t.Fatalf("frozen %t, poller paused %t, freezer %v, want nothing frozen", tr.frozen, tr.poller.paused, freezer.calls)
+	}
+	// It's still watched, and paused afresh, so not frozen again for a while.
+	observeCpu(t, tr, p, 20, 20, 20)
+	want := []EventType{EventFrozen, EventMisbehaving}
+	if !reflect.DeepEqual(events.types(), want) || time.Since(tr.stateSince) > time.Minute {
+		t.Errorf("got events %v, want %v, paused for %s", events.types(), want, time.Since(tr.stateSince))
+	}
+}
+
+func TestTrackerShutdownThaws(t *testing.T) {
+	o := trackerTestOptions
+	o.FreezePaused = 30
+	defer withOptions(o)()
+	tr, _, events := newTestTracker(StatePaused)
+	freezer := &fakeFreezer{}
+	tr.freezer = freezer
+	p := Process{Pid: "42", Command: "Spotify"}
+
+	observeCpu(t, tr, p, 1)
+	tr.stateSince = tr.stateSince.Add(-31 * time.Minute)
+	observeCpu(t, tr, p, 1)
+	tr.Shutdown()
+	want := []EventType{EventFrozen, EventThawed}
+	if tr.frozen || !reflect.DeepEqual(events.types(), want) || !reflect.DeepEqual(freezer.calls, []string{"freeze 42", "thaw"}) {
+		t.Errorf("frozen %t, events %v, freezer %v", tr.frozen, events.types(), freezer.calls)
+	}
+}
+
+func TestTrackerMetrics(t *testing.T) {
+	defer withOptions(trackerTestOptions)()
+	tr, _, _ := newTestTracker(StatePlaying)
+
+	if tags, _ := tr.Metrics(); tags["player_state"] != "closed" {
+		t.Errorf("before Spotify runs: got state %q, want closed", tags["player_state"])
+	}
+	observeCpu(t, tr, Process{Pid: "1", Command: "Spotify"}, 20, 20, 20)
+	tags, fields := tr.Metrics()
+	if tags["player_state"] != "playing" {
+		t.Errorf("got state %q, want playing", tags["player_state"])
+	}
+	for k, want := range map[string]interface{}{
+		"median": 20.0, "samples": 3, "breaches": 1, "allowed_breaches": 2, "threshold": 8.0, "misbehaving": true, "closing": false,
+	} {
+		if fields[k] != want {
+			t.Errorf("%s: got %v, want %v", k, fields[k], want)
+		}
+	}
+}
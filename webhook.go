@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Webhook POSTs each tracker event to a URL, in the background. The body is the
+// event as JSON, unless a template is given. Failed requests are retried with
+// exponential backoff. Implements EventHandler.
+type Webhook struct {
+	*EventQueue
+	url     string
+	header  http.Header
+	body    *template.Template
+	client  *http.Client
+	retries int
+	backoff time.Duration
+
+	failures uint64
+}
+
+// NewWebhook starts sending events to url. Headers are given as "Name: value".
+// The body template, if any, is executed with the Event, and may use the json
+// function to encode values, e.g. {"text": {{json .Type}}}.
+func NewWebhook(url string, headers []string, body string, retries int) (*Webhook, error) {
+	w := &Webhook{
+		url:     url,
+		header:  make(http.Header),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		retries: retries,
+		backoff: time.Second,
+	}
+	w.header.Set("Content-Type", "application/json")
+	if err := parseHeaders(w.header, headers); err != nil {
+		return nil, err
+	}
+	if body != "" {
+		tmpl, err := template.New("webhook").Funcs(template.FuncMap{"json": jsonValue}).Parse(body)
+		if err != nil {
+			return nil, err
+		}
+		w.body = tmpl
+	}
+	w.EventQueue = NewEventQueue("Webhook", w.deliver)
+	return w, nil
+}
+
+// Failures returns the number of events which couldn't be sent.
+func (w *Webhook) Failures() uint64 {
+	return atomic.LoadUint64(&w.failures) + w.Dropped()
+}
+
+func (w *Webhook) deliver(e Event) {
+	body, err := w.render(e)
+	if err == nil {
+		err = w.post(body)
+	}
+	if err != nil {
+		log.Printf("Webhook failed on %q event: %s\n", e.Type, err)
+		atomic.AddUint64(&w.failures, 1)
+	}
+}
+
+func (w *Webhook) render(e Event) ([]byte, error) {
+	if w.body == nil {
+		return e.JSON(), nil
+	}
+	var buf bytes.Buffer
+	err := w.body.Execute(&buf, e)
+	return buf.Bytes(), err
+}
+
+// post sends the body, retrying on network errors and server errors.
+func (w *Webhook) post(body []byte) (err error) {
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		if retry, err = w.send(body); err == nil || !retry || attempt >= w.retries {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// send makes a single request, returning whether it's worth trying again.
+func (w *Webhook) send(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range w.header {
+		req.Header[k] = v
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("%s", resp.Status)
+	}
+	return false, nil
+}
+
+// parseHeaders sets the headers, given as "Name: value".
+func parseHeaders(header http.Header, headers []string) error {
+	for _, h := range headers {
+		i := strings.Index(h, ":")
+		if i < 1 {
+			return fmt.Errorf("invalid header %q, expected \"Name: value\"", h)
+		}
+		header.Set(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	return nil
+}
+
+func jsonValue(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
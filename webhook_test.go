@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookServer records each request it receives, failing the first few with
+// the given status.
+func webhookServer(failures int, status int) (*httptest.Server, chan webhookRequest) {
+	requests := make(chan webhookRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- webhookRequest{r.Header, body}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(status)
+		}
+	}))
+	return server, requests
+}
+
+func nextRequest(t *testing.T, requests chan webhookRequest) webhookRequest {
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook request")
+	}
+	return webhookRequest{}
+}
+
+func TestWebhookPostsEventJSON(t *testing.T) {
+	server, requests := webhookServer(0, 0)
+	defer server.Close()
+
+	w, err := NewWebhook(server.URL, []string{"Authorization: Bearer secret"}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.HandleEvent(Event{Type: EventClosing, Target: "Spotify", Pid: "42", Median: 9.5})
+
+	r := nextRequest(t, requests)
+	if got := r.header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Authorization: got %q", got)
+	}
+	if got := r.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type: got %q", got)
+	}
+	var e Event
+	if err := json.Unmarshal(r.body, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != EventClosing || e.Pid != "42" || e.Median != 9.5 {
+		t.Errorf("unexpected event: %+v", e)
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	server, requests := webhookServer(0, 0)
+	defer server.Close()
+
+	w, err := NewWebhook(server.URL, nil, `{"text": {{json (printf "%s was %s" .Target .Type)}}}`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.HandleEvent(Event{Type: EventKilled, Target: "Spotify"})
+
+	r := nextRequest(t, requests)
+	if got, want := string(r.body), `{"text": "Spotify was killed"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	server, requests := webhookServer(2, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	w, err := NewWebhook(server.URL, nil, "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.backoff = time.Millisecond
+	w.HandleEvent(Event{Type: EventRecovered})
+
+	for i := 0; i < 3; i++ {
+		nextRequest(t, requests)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if w.Failures() != 0 {
+		t.Errorf("got %d failures, want 0", w.Failures())
+	}
+}
+
+func TestWebhookDoesNotRetryClientErrors(t *testing.T) {
+	server, requests := webhookServer(5, http.StatusBadRequest)
+	defer server.Close()
+
+	w, err := NewWebhook(server.URL, nil, "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.backoff = time.Millisecond
+	w.HandleEvent(Event{Type: EventRecovered})
+
+	nextRequest(t, requests)
+	select {
+	case <-requests:
+		t.Error("client error should not be retried")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if w.Failures() != 1 {
+		t.Errorf("got %d failures, want 1", w.Failures())
+	}
+}
+
+func TestWebhookInvalidHeader(t *testing.T) {
+	if _, err := NewWebhook("http://localhost", []string{"nope"}, "", 0); err == nil {
+		t.Error("expected error for invalid header")
+	}
+}
@@ -0,0 +1,71 @@
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// X11 finds the active window through the EWMH properties that the window
+// manager keeps on the root window, using xprop. Implements ActiveWindow.
+type X11 struct {
+	display string
+}
+
+// NewX11 returns the active window finder for an X display, such as ":0".
+func NewX11(display string) X11 {
+	return X11{display: display}
+}
+
+func (x X11) xprop(ctx context.Context, args ...string) (string, error) {
+	args = append([]string{"-display", x.display, "-notype"}, args...)
+	out, err := exec.CommandContext(ctx, "xprop", args...).Output()
+	if err != nil {
+		return "", err
+	}
+	return parseXprop(string(out))
+}
+
+// Pid returns the PID of the active window's client, from its _NET_WM_PID.
+func (x X11) Pid(ctx context.Context) (int, error) {
+	window, err := x.xprop(ctx, "-root", "_NET_ACTIVE_WINDOW")
+	if err != nil {
+		return 0, err
+	}
+	if n, err := strconv.ParseUint(window, 0, 32); err != nil || n == 0 {
+		return 0, fmt.Errorf("no active window")
+	}
+	pid, err := x.xprop(ctx, "-id", window, "_NET_WM_PID")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(pid)
+}
+
+// parseXprop returns the value of a single property printed by xprop, such as
+// "_NET_ACTIVE_WINDOW: window id # 0x3a00007" or "_NET_WM_PID = 1234".
+func parseXprop(out string) (string, error) {
+	out = strings.TrimSpace(out)
+	if strings.HasSuffix(out, "not found.") || strings.HasSuffix(out, "no such atom on any window.") {
+		return "", fmt.Errorf("xprop: %s", out)
+	}
+	fields := strings.Fields(out)
+	if len(fields) < 2 {
+		return "", fmt.Errorf("xprop: bad output %q", out)
+	}
+	return fields[len(fields)-1], nil
+}
+
+// newActiveWindow returns the X display's active window finder, if there's a
+// display to ask.
+func newActiveWindow() ActiveWindow {
+	if display := os.Getenv("DISPLAY"); display != "" {
+		return NewX11(display)
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+var parseXpropTestTable = []struct {
+	out   string
+	value string
+	ok    bool
+}{
+	{"_NET_ACTIVE_WINDOW: window id # 0x3a00007\n", "0x3a00007", true},
+	{"_NET_WM_PID = 1234\n", "1234", true},
+	{"_NET_WM_PID:  not found.\n", "", false},
+	{"_NET_ACTIVE_WINDOW:  no such atom on any window.\n", "", false},
+	{"", "", false},
+}
+
+func TestParseXprop(t *testing.T) {
+	for _, tt := range parseXpropTestTable {
+		value, err := parseXprop(tt.out)
+		if (err == nil) != tt.ok || value != tt.value {
+			t.Errorf("parseXprop(%q): got %q (%v), want %q", tt.out, value, err, tt.value)
+		}
+	}
+}
+
+// fakeXprop puts an xprop on the PATH which answers as though the window
+// manager has the given window active, owned by pid.
+func fakeXprop(t *testing.T, window, pid string) (cleanup func()) {
+	dir, err := ioutil.TempDir("", "xprop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := `#!/bin/sh
+case "$*" in
+*-root*) echo "_NET_ACTIVE_WINDOW: window id # ` + window + `" ;;
+*"-id ` + window + `"*) echo "_NET_WM_PID = ` + pid + `" ;;
+*) echo "_NET_WM_PID:  not found." ;;
+esac
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "xprop"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestX11Pid(t *testing.T) {
+	defer fakeXprop(t, "0x3a00007", "4321")()
+	if pid, err := NewX11(":0").Pid(context.Background()); err != nil || pid != 4321 {
+		t.Errorf("got %d (%v), want 4321", pid, err)
+	}
+}
+
+func TestX11NoActiveWindow(t *testing.T) {
+	defer fakeXprop(t, "0x0", "4321")()
+	if pid, err := NewX11(":0").Pid(context.Background()); err == nil {
+		t.Errorf("got %d, want error", pid)
+	}
+}
+
+// startXvfb starts a virtual X server of our own, returning its display. The
+// test is skipped if there's no Xvfb to run, or xprop to ask it with.
+func startXvfb(t *testing.T) (display string, cleanup func()) {
+	xvfb, err := exec.LookPath("Xvfb")
+	if err != nil {
+		t.Skip("Xvfb not found")
+	}
+	if _, err := exec.LookPath("xprop"); err != nil {
+		t.Skip("xprop not found")
+	}
+	// Xvfb picks a free display, and prints its number once it's ready.
+	cmd := exec.Command(xvfb, "-displayfd", "1", "-nolisten", "tcp", "-screen", "0", "640x480x24")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		cmd.Process.Kill()
+		t.Fatal(err)
+	}
+	return ":" + strings.TrimSpace(n), func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+}
+
+// xClient speaks just enough of the X protocol to make a window, and set
+// properties on it, without any X libraries. Its windows last until it's
+// closed.
+type xClient struct {
+	conn net.Conn
+	ids  uint32 // The base of the IDs we may give our windows.
+	root uint32
+}
+
+// Predefined atoms.
+const (
+	xCardinal = 6
+	xWindow   = 33
+)
+
+func dialX(t *testing.T, display string) *xClient {
+	conn, err := net.Dial("unix", "/tmp/.X11-unix/X"+strings.TrimPrefix(display, ":"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	// Little-endian, protocol 11.0, no authorization.
+	if _, err := conn.Write([]byte{'l', 0, 11, 0, 0, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	setup := make([]byte, 4*int(binary.LittleEndian.Uint16(header[6:])))
+	if _, err := io.ReadFull(conn, setup); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != 1 {
+		t.Fatalf("X server refused connection: %q", setup)
+	}
+	// The first screen's root window follows the vendor and pixmap formats.
+	vendor := int(binary.LittleEndian.Uint16(setup[16:]))
+	formats := int(setup[21])
+	screens := 32 + (vendor+3)/4*4 + 8*formats
+	return &xClient{
+		conn: conn,
+		ids:  binary.LittleEndian.Uint32(setup[4:]),
+		root: binary.LittleEndian.Uint32(setup[screens:]),
+	}
+}
+
+// request sends a request, of a whole number of words.
+func (x *xClient) request(t *testing.T, opcode, data byte, body ...uint32) {
+	req := make([]byte, 4+4*len(body))
+	req[0], req[1] = opcode, data
+	binary.LittleEndian.PutUint16(req[2:], uint16(len(req)/4))
+	for i, word := range body {
+		binary.LittleEndian.PutUint32(req[4+4*i:], word)
+	}
+	if _, err := x.conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reply reads the reply to the last request, which must have one.
+func (x *xClient) reply(t *testing.T) []byte {
+	reply := make([]byte, 32)
+	if _, err := io.ReadFull(x.conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] == 0 {
+		t.Fatalf("X error %d, for request %d", reply[1], reply[10])
+	}
+	if extra := binary.LittleEndian.Uint32(reply[4:]); extra > 0 {
+		if _, err := io.CopyN(ioutil.Discard, x.conn, int64(4*extra)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return reply
+}
+
+func (x *xClient) internAtom(t *testing.T, name string) uint32 {
+	body := make([]byte, 4+(len(name)+3)/4*4)
+	binary.LittleEndian.PutUint16(body, uint16(len(name)))
+	copy(body[4:], name)
+	words := make([]uint32, len(body)/4)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(body[4*i:])
+	}
+	x.request(t, 16, 0, words...) // InternAtom
+	return binary.LittleEndian.Uint32(x.reply(t)[8:])
+}
+
+// setProperty replaces a property of the window with a single 32-bit value.
+func (x *xClient) setProperty(t *testing.T, window, property, typ, value uint32) {
+	x.request(t, 18, 0, window, property, typ, 32, 1, value) // ChangeProperty
+}
+
+// createWindow makes and maps a window, returning its ID.
+func (x *xClient) createWindow(t *testing.T) uint32 {
+	window := x.ids
+	x.request(t, 1, 0, window, x.root, 0, 100|100<<16, 0|1<<16, 0, 0) // CreateWindow
+	x.request(t, 8, 0, window)                                        // MapWindow
+	return window
+}
+
+// sync waits for the server to have handled every request so far.
+func (x *xClient) sync(t *testing.T) {
+	x.request(t, 43, 0) // GetInputFocus
+	x.reply(t)
+}
+
+func TestX11PidOnXvfb(t *testing.T) {
+	display, cleanup := startXvfb(t)
+	defer cleanup()
+	x := dialX(t, display)
+	defer x.conn.Close()
+
+	// Our window, which says it's ours, made active as a window manager would.
+	window := x.createWindow(t)
+	x.setProperty(t, window, x.internAtom(t, "_NET_WM_PID"), xCardinal, uint32(os.Getpid()))
+	x.setProperty(t, x.root, x.internAtom(t, "_NET_ACTIVE_WINDOW"), xWindow, window)
+	x.sync(t)
+
+	if pid, err := NewX11(display).Pid(context.Background()); err != nil || pid != os.Getpid() {
+		t.Errorf("got %d (%v), want %d", pid, err, os.Getpid())
+	}
+
+	// With no window active, there's nothing to be in the foreground.
+	x.setProperty(t, x.root, x.internAtom(t, "_NET_ACTIVE_WINDOW"), xWindow, 0)
+	x.sync(t)
+	if pid, err := NewX11(display).Pid(context.Background()); err == nil {
+		t.Errorf("got %d, want error", pid)
+	}
+}
+
+func TestMPRISForeground(t *testing.T) {
+	addr, cleanup := privateBus(t)
+	defer cleanup()
+
+	// The fake player is on the bus from this process, so it owns the window.
+	_, service := exportFakeMPRIS(t, addr, "Paused")
+	defer service.Close()
+	conn, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	m := NewMPRIS(conn, mprisSpotify, activeWindow(os.Getpid()))
+	if s, err := m.State(context.Background()); err != nil || s != StateForeground {
+		t.Errorf("got %s (%v), want %s", s, err, StateForeground)
+	}
+	m = NewMPRIS(conn, mprisSpotify, activeWindow(1))
+	if s, err := m.State(context.Background()); err != nil || s != StatePaused {
+		t.Errorf("someone else's window: got %s (%v), want %s", s, err, StatePaused)
+	}
+}